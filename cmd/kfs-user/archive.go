@@ -0,0 +1,395 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Formats of archives.
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+// archiveContentTypes are the content types of the formats of archives.
+var archiveContentTypes = map[string]string{
+	archiveZip:   "application/zip",
+	archiveTar:   "application/x-tar",
+	archiveTarGz: "application/gzip",
+}
+
+// Limits of archives, set by command line options.
+var (
+	archiveMaxSize  int64 = 10 << 30
+	archiveMaxFiles       = 100000
+)
+
+// archiveManifest is the name of the file listing the entries which could not
+// be archived. It is only added if there are such entries.
+const archiveManifest = "kfs-skipped.txt"
+
+// errArchiveTooLarge is returned when an archive exceeds the limits.
+var errArchiveTooLarge = errors.New("archive too large")
+
+// archiveEntry is a file, directory or symbolic link to archive.
+type archiveEntry struct {
+	path string // path of the file
+	name string // slash-separated name in the archive
+	fi   os.FileInfo
+}
+
+// archiveCollector lists the entries to archive within the limits.
+type archiveCollector struct {
+	dir     *limitDir // exported directory of the entries
+	entries []archiveEntry
+	skipped []string // entries which cannot be archived, with the reason
+	size    int64    // total size of regular files
+}
+
+// skip records an entry which cannot be archived.
+func (c *archiveCollector) skip(name string, reason error) {
+	fmt.Printf("INFO: not archiving %s: %v\n", name, reason)
+	c.skipped = append(c.skipped, fmt.Sprintf("%s: %v", name, reason))
+}
+
+// add adds an entry and checks the limits.
+func (c *archiveCollector) add(e archiveEntry) error {
+	c.entries = append(c.entries, e)
+	if e.fi.Mode().IsRegular() {
+		c.size += e.fi.Size()
+	}
+	if len(c.entries) > archiveMaxFiles || c.size > archiveMaxSize {
+		return errArchiveTooLarge
+	}
+	return nil
+}
+
+// walk adds the tree of root under name. Symbolic links are not followed, so
+// that the tree stays in the exported directory. Unreadable directories and
+// special files are skipped. Hidden entries are left out without notice.
+func (c *archiveCollector) walk(root, name string) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(root, p)
+		if relErr != nil {
+			return relErr
+		}
+		entryName := path.Join(name, filepath.ToSlash(rel))
+
+		if fi != nil && c.dir.hiddenPath(p) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			c.skip(entryName, err)
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case fi.Mode().IsRegular(), fi.IsDir(), fi.Mode()&os.ModeSymlink != 0:
+			return c.add(archiveEntry{path: p, name: entryName, fi: fi})
+		default:
+			c.skip(entryName, errors.New("special file"))
+			return nil
+		}
+	})
+}
+
+// archiveWriter writes an archive.
+type archiveWriter struct {
+	zw      *zip.Writer
+	gz      *gzip.Writer
+	tw      *tar.Writer
+	skipped []string
+}
+
+func newArchiveWriter(w io.Writer, format string) *archiveWriter {
+	a := &archiveWriter{}
+	switch format {
+	case archiveZip:
+		a.zw = zip.NewWriter(w)
+	case archiveTar:
+		a.tw = tar.NewWriter(w)
+	default:
+		a.gz = gzip.NewWriter(w)
+		a.tw = tar.NewWriter(a.gz)
+	}
+	return a
+}
+
+// writeFile adds a file with the content.
+func (a *archiveWriter) writeFile(name string, fi os.FileInfo, content io.Reader, linkTarget string) error {
+	if a.zw != nil {
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		switch {
+		case fi.IsDir():
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+		case fi.Mode().IsRegular():
+			hdr.Method = zip.Deflate
+		default:
+			hdr.Method = zip.Store
+		}
+		w, err := a.zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if content != nil {
+			_, err = io.CopyN(w, content, fi.Size())
+		} else if linkTarget != "" {
+			_, err = io.WriteString(w, linkTarget)
+		}
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, linkTarget)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if content != nil {
+		_, err = io.CopyN(a.tw, content, fi.Size())
+	}
+	return err
+}
+
+// add adds the entry. Files which cannot be opened are skipped. Other errors
+// abort the archive.
+func (a *archiveWriter) add(e archiveEntry) error {
+	switch {
+	case e.fi.Mode().IsRegular():
+		f, err := os.Open(e.path)
+		if err != nil {
+			fmt.Printf("INFO: not archiving %s: %v\n", e.name, err)
+			a.skipped = append(a.skipped, fmt.Sprintf("%s: %v", e.name, err))
+			return nil
+		}
+		defer f.Close()
+		return a.writeFile(e.name, e.fi, f, "")
+
+	case e.fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(e.path)
+		if err != nil {
+			a.skipped = append(a.skipped, fmt.Sprintf("%s: %v", e.name, err))
+			return nil
+		}
+		return a.writeFile(e.name, e.fi, nil, target)
+
+	default:
+		return a.writeFile(e.name, e.fi, nil, "")
+	}
+}
+
+// manifestInfo describes the manifest file.
+type manifestInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (m manifestInfo) Name() string      { return archiveManifest }
+func (m manifestInfo) Size() int64       { return m.size }
+func (m manifestInfo) Mode() os.FileMode { return 0644 }
+func (m manifestInfo) IsDir() bool       { return false }
+func (m manifestInfo) Sys() interface{}  { return nil }
+
+// close adds the manifest of skipped entries, if any, and ends the archive.
+func (a *archiveWriter) close(ref os.FileInfo) error {
+	if len(a.skipped) != 0 {
+		manifest := "The following entries could not be archived:\n" + strings.Join(a.skipped, "\n") + "\n"
+		fi := manifestInfo{FileInfo: ref, size: int64(len(manifest))}
+		if err := a.writeFile(archiveManifest, fi, strings.NewReader(manifest), ""); err != nil {
+			return err
+		}
+	}
+
+	if a.zw != nil {
+		return a.zw.Close()
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
+
+// writeArchive sends the archive of the collected entries.
+func writeArchive(w http.ResponseWriter, r *http.Request, c *archiveCollector, format, filename string, ref os.FileInfo) {
+	w.Header().Set("Content-Type", archiveContentTypes[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + "." + format}))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	a := newArchiveWriter(w, format)
+	a.skipped = c.skipped
+	for _, e := range c.entries {
+		if err := a.add(e); err != nil {
+			// The answer is already started: the connection is
+			// aborted so that the client sees the failure.
+			fmt.Printf("ERROR: archiving %s: %v\n", e.path, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := a.close(ref); err != nil {
+		fmt.Printf("ERROR: ending archive: %v\n", err)
+	}
+}
+
+// archiveError replies to an archive request with the HTTP status matching the
+// error.
+func archiveError(w http.ResponseWriter, err error) {
+	if err == errArchiveTooLarge {
+		http.Error(w, fmt.Sprintf("403 Forbidden: archive exceeds the limits (%d files, %d bytes)", archiveMaxFiles, archiveMaxSize), http.StatusForbidden)
+		return
+	}
+	writeError(w, err)
+}
+
+// archiveName returns the name of the archive of the directory.
+func archiveName(dir string) string {
+	name := filepath.Base(dir)
+	if name == "/" {
+		return "root"
+	}
+	return name
+}
+
+// serveArchive sends an archive of the directory, whose entries are under the
+// name of the directory.
+func (rt *route) serveArchive(w http.ResponseWriter, r *http.Request, dir, format string) {
+	if _, ok := archiveContentTypes[format]; !ok {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		archiveError(w, err)
+		return
+	}
+
+	name := archiveName(dir)
+
+	c := &archiveCollector{dir: rt.dir}
+	if err := c.walk(dir, name); err != nil {
+		fmt.Printf("ERROR: archiving %s: %v\n", dir, err)
+		archiveError(w, err)
+		return
+	}
+	fmt.Printf("INFO: archiving %s (%d entries, %d bytes)\n", dir, len(c.entries), c.size)
+
+	writeArchive(w, r, c, format, name, fi)
+}
+
+// isSelected returns true if the name is one of the selected names or is
+// inside one of them.
+func isSelected(name string, selected []string) bool {
+	for _, s := range selected {
+		if isInside(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveSelection sends an archive of the entries of the directory of the
+// request given by the path parameters of a POST request. The paths are
+// relative to the directory and are kept in the archive. Directories are
+// archived with their content.
+func (rt *route) serveSelection(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = archiveZip
+	}
+	if _, ok := archiveContentTypes[format]; !ok || len(r.Form["path"]) == 0 {
+		writeError(w, errInvalidRequest)
+		return
+	}
+
+	dir, err := rt.resolveDir(rt.name(r))
+	if err != nil {
+		archiveError(w, err)
+		return
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		archiveError(w, err)
+		return
+	}
+
+	// Entries inside a selected directory are only archived once.
+	var names []string
+	for _, p := range r.Form["path"] {
+		name := strings.TrimPrefix(path.Clean("/"+p), "/")
+		if name == "" {
+			writeError(w, errInvalidRequest)
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c := &archiveCollector{dir: rt.dir}
+	var selected []string
+	for _, name := range names {
+		if isSelected(name, selected) {
+			continue
+		}
+		selected = append(selected, name)
+
+		p, err := rt.resolveEntry(path.Join(rt.name(r), name))
+		if err == nil {
+			_, err = os.Lstat(p)
+		}
+		if err != nil {
+			archiveError(w, err)
+			return
+		}
+		if err := c.walk(p, name); err != nil {
+			fmt.Printf("ERROR: archiving %s: %v\n", p, err)
+			archiveError(w, err)
+			return
+		}
+	}
+	fmt.Printf("INFO: archiving %d selected entries of %s (%d entries, %d bytes)\n", len(names), dir, len(c.entries), c.size)
+
+	writeArchive(w, r, c, format, archiveName(dir), fi)
+}
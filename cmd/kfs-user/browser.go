@@ -0,0 +1,321 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// browserTemplate is the HTML page of directories. It has no external assets
+// and does not need JavaScript: sorting and filtering are done by the server.
+const browserTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+nav { font-size: 1.2em; margin-bottom: 1em; }
+nav a { text-decoration: none; }
+form { display: inline-block; margin: 0 2em 1em 0; }
+form.selection { display: block; margin: 0; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: 0.3em 0.8em; text-align: left; white-space: nowrap; }
+th { border-bottom: 2px solid #ccc; }
+th a { color: inherit; }
+tr:nth-child(even) td { background: #f4f4f4; }
+td.size, th.size { text-align: right; }
+td.name { width: 100%; white-space: normal; }
+.icon { padding-right: 0.4em; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<nav>
+{{- range $i, $c := .Crumbs}}{{if $i}} / {{end}}{{if $c.URL}}<a href="{{$c.URL}}">{{$c.Name}}</a>{{else}}<strong>{{$c.Name}}</strong>{{end}}{{end -}}
+</nav>
+<form method="get" action="">
+<input type="search" name="filter" value="{{.Filter}}" placeholder="Filter names">
+<input type="hidden" name="sort" value="{{.Sort}}">
+<input type="hidden" name="order" value="{{.Order}}">
+<input type="submit" value="Filter">
+{{- if .Filter}} <a href="{{.ClearFilterURL}}">Clear</a>{{end}}
+</form>
+{{- if .Writable}}
+<form method="post" action="" enctype="multipart/form-data">
+<input type="file" name="file" multiple>
+<input type="submit" value="Upload">
+</form>
+{{- end}}
+<form class="selection" method="post" action="?op=archive">
+<table>
+<thead>
+<tr>
+<th></th>
+<th><a href="{{.SortURLs.name}}">Name{{index .SortMarks "name"}}</a></th>
+<th class="size"><a href="{{.SortURLs.size}}">Size{{index .SortMarks "size"}}</a></th>
+<th><a href="{{.SortURLs.mtime}}">Modified{{index .SortMarks "mtime"}}</a></th>
+<th>Mode</th>
+<th>Owner</th>
+</tr>
+</thead>
+<tbody>
+{{- if .ParentURL}}
+<tr><td></td><td class="name"><span class="icon">&#x2B06;&#xFE0F;</span><a href="{{.ParentURL}}">Parent directory</a></td><td></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr>
+<td><input type="checkbox" name="path" value="{{.Name}}"></td>
+<td class="name"><span class="icon">{{.Icon}}</span><a href="{{.URL}}">{{.Name}}</a>{{if .Target}} <span class="muted">&rarr; {{.Target}}</span>{{end}}</td>
+<td class="size">{{.HumanSize}}</td>
+<td>{{.ModTime.Format "2006-01-02 15:04"}}</td>
+<td><code>{{.Mode}}</code></td>
+<td>{{.Owner}}:{{.Group}}</td>
+</tr>
+{{- else}}
+<tr><td class="name muted" colspan="6">{{if .Filter}}No entry matches the filter.{{else}}Empty directory.{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+<p>Download the selected entries:
+<button type="submit" name="format" value="zip">zip</button>
+<button type="submit" name="format" value="tar.gz">tar.gz</button>
+<button type="submit" name="format" value="tar">tar</button>
+</p>
+</form>
+<p class="muted">{{len .Entries}} entries &middot; Download the directory: <a href="?archive=zip">zip</a> <a href="?archive=tar.gz">tar.gz</a> <a href="?archive=tar">tar</a></p>
+</body>
+</html>
+`
+
+var browserPage = template.Must(template.New("browser").Parse(browserTemplate))
+
+// crumb is a component of the path of the directory.
+type crumb struct {
+	Name string
+	URL  string // empty for the current directory
+}
+
+// browserEntry is an entry of the directory page.
+type browserEntry struct {
+	dirEntry
+	URL       string
+	Icon      string
+	HumanSize string
+	isDir     bool // directory or symbolic link to a directory
+}
+
+// browserData are the data of the directory page.
+type browserData struct {
+	Path           string
+	Crumbs         []crumb
+	ParentURL      string
+	Entries        []browserEntry
+	Filter         string
+	Sort           string
+	Order          string
+	SortURLs       map[string]string
+	SortMarks      map[string]string
+	ClearFilterURL string
+	Writable       bool // files can be uploaded
+}
+
+// humanSize returns the size with a binary unit.
+func humanSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB", "PiB"} {
+		value /= 1024
+		if value < 1024 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f EiB", value/1024)
+}
+
+// Icons of regular files by extension.
+var fileIcons = map[string]string{
+	".txt": "\U0001F4C4", ".log": "\U0001F4C4", ".md": "\U0001F4C4", ".csv": "\U0001F4CA",
+	".pdf": "\U0001F4D5",
+	".png": "\U0001F5BC", ".jpg": "\U0001F5BC", ".jpeg": "\U0001F5BC", ".gif": "\U0001F5BC", ".svg": "\U0001F5BC",
+	".zip": "\U0001F4E6", ".tar": "\U0001F4E6", ".gz": "\U0001F4E6", ".tgz": "\U0001F4E6", ".bz2": "\U0001F4E6", ".xz": "\U0001F4E6",
+	".c": "\U0001F4DC", ".h": "\U0001F4DC", ".go": "\U0001F4DC", ".py": "\U0001F4DC", ".sh": "\U0001F4DC", ".f90": "\U0001F4DC",
+}
+
+// entryIcon returns the icon of the entry.
+func entryIcon(e *dirEntry, isDir bool) string {
+	switch {
+	case isDir:
+		return "\U0001F4C1"
+	case e.Type == entrySymlink:
+		return "\U0001F517"
+	case e.Type == entryOther:
+		return "⚙"
+	}
+	if icon, ok := fileIcons[strings.ToLower(filepath.Ext(e.Name))]; ok {
+		return icon
+	}
+	return "\U0001F4C4"
+}
+
+// sortEntries sorts the entries by the column, directories first.
+func sortEntries(entries []browserEntry, column string, desc bool) {
+	less := func(a, b *browserEntry) bool {
+		switch column {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if a.isDir != b.isDir {
+			return a.isDir
+		}
+		if desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// crumbs returns the breadcrumbs of the directory: the route, then the
+// sub-directories.
+func (rt *route) crumbs(urlPath string) []crumb {
+	crumbs := []crumb{{Name: rt.pattern, URL: rt.pattern}}
+	if rt.pattern != "/" {
+		crumbs[0].Name = strings.TrimSuffix(rt.pattern, "/")
+	}
+
+	current := rt.pattern
+	for _, name := range strings.Split(strings.Trim(strings.TrimPrefix(urlPath, rt.pattern), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		current += name + "/"
+		crumbs = append(crumbs, crumb{Name: name, URL: (&url.URL{Path: current}).EscapedPath()})
+	}
+	crumbs[len(crumbs)-1].URL = ""
+
+	return crumbs
+}
+
+// serveBrowser replies with the HTML page of the directory.
+func (rt *route) serveBrowser(w http.ResponseWriter, r *http.Request, dir string) {
+	dirEntries, err := rt.dir.readDirEntries(dir)
+	if err != nil {
+		fmt.Printf("ERROR: reading directory %s: %v\n", dir, err)
+		httpError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	data := browserData{
+		Path:   r.URL.Path,
+		Crumbs: rt.crumbs(r.URL.Path),
+		Filter: query.Get("filter"),
+		Sort:   query.Get("sort"),
+		Order:  query.Get("order"),
+
+		Writable: rt.allows(opCreate),
+	}
+	switch data.Sort {
+	case "name", "size", "mtime":
+	default:
+		data.Sort = "name"
+	}
+	if data.Order != "desc" {
+		data.Order = "asc"
+	}
+	if r.URL.Path != rt.pattern {
+		data.ParentURL = "../"
+	}
+
+	filter := strings.ToLower(data.Filter)
+	for _, e := range dirEntries {
+		if filter != "" && !strings.Contains(strings.ToLower(e.Name), filter) {
+			continue
+		}
+		isDir := e.Type == entryDir
+		if e.Type == entrySymlink {
+			if fi, err := os.Stat(filepath.Join(dir, e.Name)); err == nil && fi.IsDir() {
+				isDir = true
+			}
+		}
+		be := browserEntry{
+			dirEntry:  e,
+			URL:       (&url.URL{Path: "./" + e.Name}).EscapedPath(),
+			Icon:      entryIcon(&e, isDir),
+			HumanSize: humanSize(e.Size),
+			isDir:     isDir,
+		}
+		if isDir {
+			be.URL += "/"
+			be.HumanSize = "-"
+		}
+		data.Entries = append(data.Entries, be)
+	}
+	sortEntries(data.Entries, data.Sort, data.Order == "desc")
+
+	data.SortURLs = make(map[string]string)
+	data.SortMarks = make(map[string]string)
+	for _, column := range []string{"name", "size", "mtime"} {
+		order := "asc"
+		if column == data.Sort {
+			if data.Order == "asc" {
+				order = "desc"
+				data.SortMarks[column] = " ▲"
+			} else {
+				data.SortMarks[column] = " ▼"
+			}
+		}
+		v := url.Values{"sort": {column}, "order": {order}}
+		if data.Filter != "" {
+			v.Set("filter", data.Filter)
+		}
+		data.SortURLs[column] = "?" + v.Encode()
+	}
+	data.ClearFilterURL = "?" + url.Values{"sort": {data.Sort}, "order": {data.Order}}.Encode()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := browserPage.Execute(w, data); err != nil {
+		fmt.Printf("ERROR: rendering listing of %s: %v\n", dir, err)
+	}
+}
+
+// isBrowsable returns true if the directory page must be served for the
+// request: the path ends with a slash and the directory has no visible
+// index.html file (served by the file server).
+func (rt *route) isBrowsable(r *http.Request, dir string) bool {
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	index := path.Join(dir, "index.html")
+	_, err := os.Stat(index)
+	return os.IsNotExist(err) || (err == nil && rt.dir.hiddenPath(index))
+}
@@ -0,0 +1,279 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A checksumAlgorithm computes checksums of files.
+type checksumAlgorithm struct {
+	name       string // name of the checksum parameter
+	digestName string // name of the digest in HTTP fields (RFC 9530)
+	newHash    func() hash.Hash
+}
+
+// checksumAlgorithms are the supported algorithms, by order of preference.
+var checksumAlgorithms = []checksumAlgorithm{
+	{"sha256", "sha-256", sha256.New},
+	{"sha1", "sha", sha1.New},
+	{"md5", "md5", md5.New},
+	{"crc32c", "crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+}
+
+// lookupChecksum returns the algorithm of the checksum parameter.
+func lookupChecksum(name string) (*checksumAlgorithm, bool) {
+	for i := range checksumAlgorithms {
+		if checksumAlgorithms[i].name == name {
+			return &checksumAlgorithms[i], true
+		}
+	}
+	return nil, false
+}
+
+// wantedDigest returns the supported algorithm preferred by the
+// Want-Repr-Digest header (RFC 9530 section 4), or false if there is none.
+// The header is a dictionary of algorithms with a preference from 1 to 10; 0
+// means that the algorithm is not acceptable.
+func wantedDigest(header string) (*checksumAlgorithm, bool) {
+	var best *checksumAlgorithm
+	bestPref := 0
+	for _, member := range strings.Split(header, ",") {
+		key, value := strings.TrimSpace(member), "1"
+		if i := strings.IndexByte(key, '='); i >= 0 {
+			key, value = strings.TrimSpace(key[:i]), strings.TrimSpace(key[i+1:])
+		}
+		pref, err := strconv.Atoi(value)
+		if err != nil || pref <= bestPref {
+			continue
+		}
+		for i := range checksumAlgorithms {
+			if checksumAlgorithms[i].digestName == key {
+				best, bestPref = &checksumAlgorithms[i], pref
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// checksumCacheMaxAge is the time after which unused cache files are removed.
+const checksumCacheMaxAge = 30 * 24 * time.Hour
+
+// checksumCache records the checksums of files in the cache directory of the
+// user, so that they are only computed again when the files change. There is a
+// cache file per file, named by its device and inode numbers. The modification
+// time of a cache file is updated when it is used.
+type checksumCache struct {
+	once sync.Once
+	dir  string // empty if the cache cannot be used
+}
+
+var checksums = &checksumCache{}
+
+// cachedChecksums are the checksums of a file when it had the modification
+// time and the size.
+type cachedChecksums struct {
+	ModTime   int64             `json:"mtime"`
+	Size      int64             `json:"size"`
+	Checksums map[string]string `json:"checksums"` // hexadecimal, by algorithm
+}
+
+// directory returns the cache directory, created if needed and pruned of
+// unused cache files. The environment of the user file server is not the one
+// of the user: the home directory is taken from the user database.
+func (c *checksumCache) directory() string {
+	c.once.Do(func() {
+		u, err := user.Current()
+		if err != nil {
+			fmt.Printf("ERROR: checksums are not cached: %v\n", err)
+			return
+		}
+		dir := filepath.Join(u.HomeDir, ".cache", "kfs", "checksums")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			fmt.Printf("ERROR: checksums are not cached: %v\n", err)
+			return
+		}
+		c.dir = dir
+		c.prune()
+	})
+	return c.dir
+}
+
+// prune removes the cache files unused for checksumCacheMaxAge: the files they
+// were recorded for were likely removed, and their inodes may be reused.
+func (c *checksumCache) prune() {
+	fis, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		fmt.Printf("ERROR: pruning checksum cache: %v\n", err)
+		return
+	}
+	removed := 0
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || time.Since(fi.ModTime()) < checksumCacheMaxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil {
+			fmt.Printf("ERROR: pruning checksum cache: %v\n", err)
+			continue
+		}
+		removed++
+	}
+	if removed != 0 {
+		fmt.Printf("INFO: removed %d unused checksum cache files\n", removed)
+	}
+}
+
+// path returns the path of the cache file of the file, or an empty string.
+func (c *checksumCache) path(fi os.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || c.directory() == "" {
+		return ""
+	}
+	return filepath.Join(c.dir, fmt.Sprintf("%x-%x", st.Dev, st.Ino))
+}
+
+// load returns the cached checksums of the file if it did not change.
+func (c *checksumCache) load(fi os.FileInfo) *cachedChecksums {
+	cached := &cachedChecksums{ModTime: fi.ModTime().UnixNano(), Size: fi.Size(), Checksums: make(map[string]string)}
+	p := c.path(fi)
+	if p == "" {
+		return cached
+	}
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return cached
+	}
+	var old cachedChecksums
+	if json.Unmarshal(content, &old) != nil || old.ModTime != cached.ModTime || old.Size != cached.Size || old.Checksums == nil {
+		// Stale entry of a changed file or of a reused inode.
+		os.Remove(p)
+		return cached
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return &old
+}
+
+// store records the checksums of the file.
+func (c *checksumCache) store(fi os.FileInfo, cached *cachedChecksums) {
+	p := c.path(fi)
+	if p == "" {
+		return
+	}
+	content, err := json.Marshal(cached)
+	if err == nil {
+		_, _, err = writeFile(c.dir, filepath.Base(p), bytes.NewReader(content), false)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: caching checksum of %s: %v\n", p, err)
+	}
+}
+
+// checksum returns the checksum of the file with the algorithm.
+func (c *checksumCache) checksum(p string, alg *checksumAlgorithm) ([]byte, error) {
+	// Special files are not opened: opening a FIFO would block.
+	if fi, err := os.Stat(p); err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, errNotRegular
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cached := c.load(fi)
+	if sum, err := hex.DecodeString(cached.Checksums[alg.name]); err == nil && len(sum) != 0 {
+		return sum, nil
+	}
+
+	h := alg.newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+	fmt.Printf("INFO: computed %s checksum of %s\n", alg.name, p)
+
+	// The file must not have changed during the computation.
+	if after, err := f.Stat(); err == nil && after.ModTime().Equal(fi.ModTime()) && after.Size() == fi.Size() {
+		cached.Checksums[alg.name] = hex.EncodeToString(sum)
+		c.store(fi, cached)
+	}
+	return sum, nil
+}
+
+// reprDigest returns the Repr-Digest field of the checksum.
+func reprDigest(alg *checksumAlgorithm, sum []byte) string {
+	return alg.digestName + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// serveChecksum sends the checksum of the file in the format of sha256sum and
+// similar tools.
+func (rt *route) serveChecksum(w http.ResponseWriter, r *http.Request, p, algName string) {
+	alg, ok := lookupChecksum(algName)
+	if !ok {
+		writeError(w, errInvalidRequest)
+		return
+	}
+	sum, err := checksums.checksum(p, alg)
+	if err != nil {
+		fmt.Printf("ERROR: checksum of %s: %v\n", p, err)
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Repr-Digest", reprDigest(alg, sum))
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, "%s  %s\n", hex.EncodeToString(sum), filepath.Base(p))
+}
+
+// addReprDigest adds the Repr-Digest header requested by the Want-Repr-Digest
+// header to the answer. Errors are only logged: the file is served without
+// the header.
+func addReprDigest(w http.ResponseWriter, r *http.Request, p string) {
+	alg, ok := wantedDigest(r.Header.Get("Want-Repr-Digest"))
+	if !ok {
+		return
+	}
+	sum, err := checksums.checksum(p, alg)
+	if err != nil {
+		fmt.Printf("ERROR: checksum of %s: %v\n", p, err)
+		return
+	}
+	w.Header().Set("Repr-Digest", reprDigest(alg, sum))
+}
@@ -0,0 +1,166 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultExclude are the patterns of the files holding secrets of the user,
+// hidden unless the default_exclude option of the route is false.
+var defaultExclude = []string{
+	".ssh", ".gnupg", ".pki", ".password-store",
+	".k5login", ".k5users", "krb5cc_*", "*.keytab",
+	".netrc", ".pgpass", ".my.cnf", ".git-credentials", ".vault-token",
+	".aws", ".azure", ".kube", ".docker",
+}
+
+// Errors of hidden entries.
+var (
+	errHidden       = errors.New("path is hidden")
+	errHiddenInside = errors.New("directory contains hidden entries")
+)
+
+// A pathFilter hides entries of an exported directory. Patterns are globs (see
+// path.Match): a pattern with a slash matches the path relative to the
+// exported directory, other patterns match the name of the entry or of one of
+// its parent directories. Excluded entries are hidden. If there are include
+// patterns, files which do not match one of them are hidden too: directories
+// are kept so that included files can be reached.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+// checkPatterns returns an error if a pattern is malformed.
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches returns true if the slash-separated path relative to the exported
+// directory, or one of its parent directories, matches one of the patterns.
+func matches(patterns []string, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			var ok bool
+			if strings.Contains(pattern, "/") {
+				ok, _ = path.Match(strings.TrimPrefix(pattern, "/"), p)
+			} else {
+				ok, _ = path.Match(pattern, path.Base(p))
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hidden returns true if the entry of the slash-separated path relative to the
+// exported directory is hidden.
+func (f *pathFilter) hidden(rel string, isDir bool) bool {
+	if f == nil || rel == "" || rel == "." {
+		return false
+	}
+	if matches(f.exclude, rel) {
+		return true
+	}
+	return len(f.include) != 0 && !isDir && !matches(f.include, rel)
+}
+
+// hidden returns true if the entry of the canonical path, in the directory, is
+// hidden.
+func (d limitDir) hidden(cleanPath string, isDir bool) bool {
+	rel, err := filepath.Rel(d.dir, cleanPath)
+	if err != nil {
+		return true
+	}
+	return d.filter.hidden(filepath.ToSlash(rel), isDir)
+}
+
+// hiddenPath is like hidden for an existing entry. Symbolic links are hidden
+// if their target is.
+func (d limitDir) hiddenPath(cleanPath string) bool {
+	fi, err := os.Stat(cleanPath)
+	if err != nil {
+		// Dangling symbolic link.
+		return d.hidden(cleanPath, false)
+	}
+	if d.hidden(cleanPath, fi.IsDir()) {
+		return true
+	}
+	if target, err := realpath(cleanPath); err == nil && target != cleanPath && d.contains(target) {
+		return d.hidden(target, fi.IsDir())
+	}
+	return false
+}
+
+// isDirPath returns true if the path is a directory or a symbolic link to a
+// directory.
+func isDirPath(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
+
+// hasHidden returns true if the tree of the canonical path contains hidden
+// entries. Symbolic links are not followed.
+func (d limitDir) hasHidden(root string) bool {
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.hidden(p, fi.IsDir()) {
+			return errHiddenInside
+		}
+		return nil
+	})
+	return err == errHiddenInside
+}
+
+// checkNew returns errHidden if an entry created with the canonical path would
+// be hidden.
+func (d limitDir) checkNew(cleanPath string, isDir bool) error {
+	if d.hidden(cleanPath, isDir) {
+		return errHidden
+	}
+	return nil
+}
+
+// filteredFile is a directory opened by the file server, whose hidden entries
+// are not listed.
+type filteredFile struct {
+	http.File
+	dir       limitDir
+	cleanPath string
+}
+
+func (f *filteredFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	visible := fis[:0]
+	for _, fi := range fis {
+		if !f.dir.hiddenPath(filepath.Join(f.cleanPath, fi.Name())) {
+			visible = append(visible, fi)
+		}
+	}
+	return visible, err
+}
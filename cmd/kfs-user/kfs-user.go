@@ -11,11 +11,13 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
@@ -27,7 +29,9 @@ import (
 )
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: kfs-user [OPTIONS] pattern1:/path/to/exported/fs1 [pattern2:/path/to/exported/fs2 ...]")
+	fmt.Fprintln(os.Stderr, "usage: kfs-user [OPTIONS] pattern1[?ROUTE_OPTIONS]:/path/to/exported/fs1 [pattern2:/path/to/exported/fs2 ...]")
+	fmt.Fprintln(os.Stderr, "\nroute options (URL query): mode=MODE, include=GLOB, exclude=GLOB, default_exclude=false")
+	fmt.Fprintln(os.Stderr, "\nrequests must have the secret of the KFS_USER_SECRET environment variable in a Kfs-User-Secret header")
 	fmt.Fprintln(os.Stderr, "\noptions:")
 	flag.PrintDefaults()
 	os.Exit(2)
@@ -49,13 +53,17 @@ func realpath(path string) (string, error) {
 	return path2, nil
 }
 
+// errOutside is returned for paths outside of an exported directory.
+var errOutside = errors.New("path outside of exported directory")
+
 // A limitDir is like a http.Dir but limit access to files in it or its
 // sub-directories.
 type limitDir struct {
-	dir string
+	dir    string
+	filter *pathFilter // hidden entries
 }
 
-func newLimitDir(path string) (*limitDir, error) {
+func newLimitDir(path string, filter *pathFilter) (*limitDir, error) {
 	if path == "" {
 		path = "."
 	}
@@ -63,38 +71,207 @@ func newLimitDir(path string) (*limitDir, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &limitDir{clean}, nil
+	return &limitDir{clean, filter}, nil
 }
 
-func (d limitDir) Open(name string) (http.File, error) {
+// contains returns true if the canonical path is the directory or is in it.
+func (d limitDir) contains(cleanPath string) bool {
+	return d.dir == "/" || cleanPath == d.dir || strings.HasPrefix(cleanPath, d.dir+"/")
+}
+
+// resolve returns the canonical path of name, a slash-separated path relative
+// to the directory, or an error if it does not exist, is outside of the
+// directory or is hidden.
+func (d limitDir) resolve(name string) (string, error) {
 	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
-		return nil, errors.New("http: invalid character in path")
+		return "", errors.New("http: invalid character in path")
 	}
 
 	fullName := filepath.Join(d.dir, filepath.FromSlash(path.Clean("/"+name)))
 	cleanPath, err := realpath(fullName)
 	if err != nil {
 		fmt.Printf("ERROR: realpath(%s): %v\n", fullName, err)
-		return nil, errors.New("http: invalid path")
+		return "", err
 	}
 
-	if !strings.HasPrefix(cleanPath, d.dir) {
+	if !d.contains(cleanPath) {
 		fmt.Printf("ERROR: %s is outside of allowed path %s: %s\n", name, d.dir, cleanPath)
-		return nil, errors.New("http: invalid path")
+		return "", errOutside
+	}
+
+	// Both the requested path and the canonical path must be visible.
+	isDir := isDirPath(cleanPath)
+	if d.hidden(cleanPath, isDir) || d.hidden(fullName, isDir) {
+		fmt.Printf("INFO: %s is hidden\n", name)
+		return "", errHidden
+	}
+
+	return cleanPath, nil
+}
+
+func (d limitDir) Open(name string) (http.File, error) {
+	cleanPath, err := d.resolve(name)
+	if err == errHidden {
+		// Answered like missing files by the file server.
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	f, err := os.Open(cleanPath)
 	if err != nil {
 		fmt.Printf("ERROR: opening %s: %v\n", cleanPath, err)
-		return nil, errors.New("http: error opening file")
+		return nil, err
+	}
+	if isDirPath(cleanPath) {
+		return &filteredFile{File: f, dir: d, cleanPath: cleanPath}, nil
 	}
 	return f, nil
 }
 
+// httpError replies to the request with the HTTP status matching the error.
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err), err == errHidden:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case os.IsPermission(err), err == errOutside:
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// A route serves the files of an exported directory under a URL path prefix.
+type route struct {
+	pattern string       // URL path prefix, ending with a slash
+	dir     *limitDir    // exported directory
+	mode    string       // access mode
+	files   http.Handler // file server of the directory
+}
+
+func newRoute(pattern string, dir *limitDir, mode string) *route {
+	return &route{
+		pattern: pattern,
+		dir:     dir,
+		mode:    mode,
+		files:   http.StripPrefix(pattern, http.FileServer(dir)),
+	}
+}
+
+// splitOptions splits the pattern argument of a route from its options.
+func splitOptions(arg string) (string, string) {
+	if i := strings.IndexByte(arg, '?'); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
+// name returns the path of the request relative to the route.
+func (rt *route) name(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, rt.pattern)
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := checkIf(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		rt.servePut(w, r)
+		return
+	case http.MethodPost:
+		switch {
+		case r.URL.Query().Get("op") == "archive":
+			// Whatever the body, as kfs lets read-only tokens
+			// send these requests.
+			rt.serveSelection(w, r)
+		case isMultipart(r):
+			rt.serveUpload(w, r)
+		default:
+			rt.serveOp(w, r)
+		}
+		return
+	case http.MethodDelete:
+		rt.serveDelete(w, r)
+		return
+	case http.MethodOptions:
+		rt.serveOptions(w, r)
+		return
+	case methodPropfind:
+		rt.servePropfind(w, r)
+		return
+	case methodProppatch:
+		rt.serveProppatch(w, r)
+		return
+	case methodMkcol:
+		rt.serveMkcol(w, r)
+		return
+	case methodCopy, methodMove:
+		rt.serveCopyMove(w, r)
+		return
+	case methodLock:
+		rt.serveLock(w, r)
+		return
+	case methodUnlock:
+		rt.serveUnlock(w, r)
+		return
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cleanPath, err := rt.dir.resolve(rt.name(r)); err == nil {
+		if fi, err := os.Stat(cleanPath); err == nil && fi.IsDir() {
+			switch {
+			case r.URL.Query().Get("archive") != "":
+				rt.serveArchive(w, r, cleanPath, r.URL.Query().Get("archive"))
+				return
+			case r.URL.Query().Get("checksum") != "":
+				writeError(w, errNotRegular)
+				return
+			case wantsJSON(r):
+				rt.serveJSONListing(w, r, cleanPath)
+				return
+			case rt.isBrowsable(r, cleanPath):
+				rt.serveBrowser(w, r, cleanPath)
+				return
+			}
+		} else if err == nil {
+			if algName := r.URL.Query().Get("checksum"); algName != "" {
+				rt.serveChecksum(w, r, cleanPath, algName)
+				return
+			}
+			addReprDigest(w, r, cleanPath)
+		}
+	}
+
+	rt.files.ServeHTTP(w, r)
+}
+
+// authenticated returns a handler serving only the requests with the secret
+// given by kfs, so that other local users cannot send requests to the server.
+func authenticated(secret string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(kfs.SecretHeader)), []byte(secret)) != 1 {
+			fmt.Printf("ERROR: %s %s: request without secret from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 	flag.Usage = usage
 	listenFlag := flag.String("listen", "127.0.0.1:", "listening address")
 	versionFlag := flag.Bool("version", false, "show version and exit")
+	flag.Int64Var(&archiveMaxSize, "archive-max-size", archiveMaxSize, "maximum total size of files in directory archives")
+	flag.IntVar(&archiveMaxFiles, "archive-max-files", archiveMaxFiles, "maximum number of files in directory archives")
 	flag.Parse()
 
 	if *versionFlag {
@@ -102,6 +279,13 @@ func main() {
 		os.Exit(0)
 	}
 
+	secret := os.Getenv(kfs.SecretEnv)
+	if secret == "" {
+		fmt.Printf("ERROR: %s is not set\n", kfs.SecretEnv)
+		os.Exit(2)
+	}
+	os.Unsetenv(kfs.SecretEnv)
+
 	if flag.NArg() == 0 {
 		fmt.Println("ERROR: no export file-system specified")
 		usage()
@@ -113,23 +297,47 @@ func main() {
 			fmt.Printf("ERROR: invalid argument: %s\n", arg)
 			usage()
 		}
-		pattern := path.Clean(fields[0])
+		// Options of the route are given as a query after the pattern.
+		patternArg, rawOptions := splitOptions(fields[0])
+		options, err := url.ParseQuery(rawOptions)
+		if err != nil {
+			fmt.Printf("ERROR: invalid options: %s: %v\n", arg, err)
+			os.Exit(2)
+		}
+		mode := options.Get("mode")
+		if mode == "" {
+			mode = modeReadOnly
+		}
+		if _, ok := modeOperations[mode]; !ok {
+			fmt.Printf("ERROR: invalid mode: %s\n", arg)
+			os.Exit(2)
+		}
+		filter := &pathFilter{include: options["include"], exclude: options["exclude"]}
+		if options.Get("default_exclude") != "false" {
+			filter.exclude = append(filter.exclude, defaultExclude...)
+		}
+		if err := checkPatterns(append(filter.include, filter.exclude...)); err != nil {
+			fmt.Printf("ERROR: invalid pattern: %s: %v\n", arg, err)
+			os.Exit(2)
+		}
+
+		pattern := path.Clean(patternArg)
 		if pattern != "/" {
 			pattern += "/"
 		}
 		exportedPath := fields[1]
-		fmt.Printf("INFO: exporting \"%s\" to \"%s\"\n", pattern, exportedPath)
+		fmt.Printf("INFO: exporting \"%s\" to \"%s\" (%s)\n", pattern, exportedPath, mode)
 
-		dir, err := newLimitDir(exportedPath)
+		dir, err := newLimitDir(exportedPath, filter)
 		if err != nil {
 			fmt.Printf("ERROR: invalid argument: %s: %v\n", exportedPath, err)
 			os.Exit(2)
 		}
 
-		http.Handle(pattern, http.StripPrefix(pattern, http.FileServer(dir)))
+		addRoute(newRoute(pattern, dir, mode))
 	}
 
-	var srv http.Server
+	srv := http.Server{Handler: authenticated(secret, http.DefaultServeMux)}
 	idleConnsClosed := make(chan struct{})
 	sigint := make(chan os.Signal, 1)
 
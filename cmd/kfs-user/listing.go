@@ -0,0 +1,176 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Types of directory entries.
+const (
+	entryFile    = "file"
+	entryDir     = "dir"
+	entrySymlink = "symlink"
+	entryOther   = "other"
+)
+
+// dirEntry describes an entry of a directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Mode    string    `json:"mode"`
+	Owner   string    `json:"owner"`
+	Group   string    `json:"group"`
+	Target  string    `json:"target,omitempty"` // target of symbolic links
+}
+
+// dirListing is a directory listing.
+type dirListing struct {
+	Path    string     `json:"path"`
+	Entries []dirEntry `json:"entries"`
+}
+
+// Cache of user and group names.
+var (
+	namesMu    sync.Mutex
+	userNames  = make(map[uint32]string)
+	groupNames = make(map[uint32]string)
+)
+
+// ownerNames returns the user and group names of the IDs (or the IDs if they
+// are unknown).
+func ownerNames(uid, gid uint32) (string, string) {
+	namesMu.Lock()
+	defer namesMu.Unlock()
+
+	owner, ok := userNames[uid]
+	if !ok {
+		owner = strconv.FormatUint(uint64(uid), 10)
+		if u, err := user.LookupId(owner); err == nil {
+			owner = u.Username
+		}
+		userNames[uid] = owner
+	}
+
+	group, ok := groupNames[gid]
+	if !ok {
+		group = strconv.FormatUint(uint64(gid), 10)
+		if g, err := user.LookupGroupId(group); err == nil {
+			group = g.Name
+		}
+		groupNames[gid] = group
+	}
+
+	return owner, group
+}
+
+// newDirEntry returns the description of the file of the directory dir. Symbolic
+// links are not followed.
+func newDirEntry(dir string, fi os.FileInfo) dirEntry {
+	// Use the Unix values of special bits.
+	mode := uint32(fi.Mode().Perm())
+	if fi.Mode()&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if fi.Mode()&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if fi.Mode()&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+
+	e := dirEntry{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Mode:    fmt.Sprintf("%04o", mode),
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		e.Type = entryFile
+	case fi.IsDir():
+		e.Type = entryDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		e.Type = entrySymlink
+		e.Target, _ = os.Readlink(filepath.Join(dir, fi.Name()))
+	default:
+		e.Type = entryOther
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		e.Owner, e.Group = ownerNames(st.Uid, st.Gid)
+	}
+
+	return e
+}
+
+// readDirEntries returns the visible entries of the directory dir, a canonical
+// path in d, sorted by name.
+func (d limitDir) readDirEntries(dir string) ([]dirEntry, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, 0, len(fis))
+	for _, fi := range fis {
+		if d.hiddenPath(filepath.Join(dir, fi.Name())) {
+			continue
+		}
+		entries = append(entries, newDirEntry(dir, fi))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries, nil
+}
+
+// wantsJSON returns true if the client asks for a JSON answer, with the
+// format=json query parameter or the Accept header.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// serveJSONListing replies with the listing of the directory in JSON.
+func (rt *route) serveJSONListing(w http.ResponseWriter, r *http.Request, dir string) {
+	entries, err := rt.dir.readDirEntries(dir)
+	if err != nil {
+		fmt.Printf("ERROR: reading directory %s: %v\n", dir, err)
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dirListing{Path: r.URL.Path, Entries: entries}); err != nil {
+		fmt.Printf("ERROR: encoding listing of %s: %v\n", dir, err)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifetime of WebDAV locks.
+const (
+	defaultLockTimeout = 10 * time.Minute
+	maxLockTimeout     = time.Hour
+)
+
+// Errors of locks.
+var (
+	errLocked       = errors.New("resource is locked")
+	errPrecondition = errors.New("precondition failed")
+)
+
+// A davLock is a WebDAV write lock of a URL path.
+type davLock struct {
+	token     string
+	root      string // clean URL path of the locked resource
+	infinite  bool   // the lock also applies to the members of the collection
+	exclusive bool
+	owner     string // owner given by the client (text or URL)
+	timeout   time.Duration
+	expires   time.Time
+	created   string // empty file created by the lock, until it is written
+}
+
+// covers returns true if the lock applies to the URL path.
+func (l *davLock) covers(urlPath string) bool {
+	return l.root == urlPath || (l.infinite && isInside(urlPath, l.root))
+}
+
+// lockStore records the WebDAV locks. Locks only exist in memory: they are
+// lost when the user file server stops.
+type lockStore struct {
+	mu    sync.Mutex
+	locks map[string]*davLock // by token
+}
+
+var locks = &lockStore{locks: make(map[string]*davLock)}
+
+// expire removes expired locks. The store must be locked.
+func (s *lockStore) expire() {
+	now := time.Now()
+	for token, l := range s.locks {
+		if now.After(l.expires) {
+			delete(s.locks, token)
+		}
+	}
+}
+
+// conflicting returns the locks applying to the URL path and, if descendants
+// is true, the locks of its members.
+func (s *lockStore) conflicting(urlPath string, descendants bool) []*davLock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	var conflicts []*davLock
+	for _, l := range s.locks {
+		if l.covers(urlPath) || (descendants && isInside(l.root, urlPath)) {
+			conflicts = append(conflicts, l)
+		}
+	}
+	return conflicts
+}
+
+// covering returns copies of the locks applying to the URL path.
+func (s *lockStore) covering(urlPath string) []davLock {
+	var covering []davLock
+	for _, l := range s.conflicting(urlPath, false) {
+		covering = append(covering, *l)
+	}
+	return covering
+}
+
+// lookup returns a copy of the lock with the token if it exists.
+func (s *lockStore) lookup(token string) (davLock, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	l, ok := s.locks[token]
+	if !ok {
+		return davLock{}, false
+	}
+	return *l, true
+}
+
+// create adds a lock unless it conflicts with existing locks: an exclusive lock
+// conflicts with any lock, a shared lock with exclusive locks.
+func (s *lockStore) create(l *davLock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	for _, other := range s.locks {
+		if !other.covers(l.root) && !(l.infinite && isInside(other.root, l.root)) {
+			continue
+		}
+		if l.exclusive || other.exclusive {
+			return errLocked
+		}
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return err
+	}
+	l.token = token
+	l.expires = time.Now().Add(l.timeout)
+	s.locks[token] = l
+	return nil
+}
+
+// refresh extends the lock with the token if it applies to the URL path.
+func (s *lockStore) refresh(token, urlPath string, timeout time.Duration) (davLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	l, ok := s.locks[token]
+	if !ok || !l.covers(urlPath) {
+		return davLock{}, errPrecondition
+	}
+	l.timeout = timeout
+	l.expires = time.Now().Add(timeout)
+	return *l, nil
+}
+
+// remove removes the lock with the token if it applies to the URL path.
+func (s *lockStore) remove(token, urlPath string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.locks[token]
+	if !ok || !l.covers(urlPath) {
+		return false
+	}
+	delete(s.locks, token)
+	return true
+}
+
+// removeTree removes the locks of the URL path and of its members, after the
+// resource is removed or moved.
+func (s *lockStore) removeTree(urlPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, l := range s.locks {
+		if isInside(l.root, urlPath) {
+			delete(s.locks, token)
+		}
+	}
+}
+
+// claimCreated returns true if the file was created by one of the locks of the
+// tokens, and forgets it: only the first write of the file is allowed to
+// replace it (see lockCreated).
+func (s *lockStore) claimCreated(tokens map[string]bool, p string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	for token := range tokens {
+		if l, ok := s.locks[token]; ok && l.created == p {
+			l.created = ""
+			return true
+		}
+	}
+	return false
+}
+
+// lockCreated returns true if the file is still the empty file created by a
+// lock of an unmapped URL submitted by the request. WebDAV clients lock a
+// file before writing it: the write must be allowed even in routes where
+// files cannot be replaced.
+func lockCreated(r *http.Request, p string) bool {
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != 0 {
+		return false
+	}
+	return locks.claimCreated(submittedTokens(r), p)
+}
+
+// newLockToken returns a random lock token (an UUID URN).
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// parseTimeout returns the lock timeout requested by the Timeout header.
+func parseTimeout(header string) time.Duration {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "Infinite" {
+			return maxLockTimeout
+		}
+		if strings.HasPrefix(value, "Second-") {
+			n, err := strconv.ParseUint(strings.TrimPrefix(value, "Second-"), 10, 32)
+			if err != nil {
+				continue
+			}
+			if timeout := time.Duration(n) * time.Second; timeout < maxLockTimeout {
+				return timeout
+			}
+			return maxLockTimeout
+		}
+	}
+	return defaultLockTimeout
+}
+
+// ifCondition is a condition of the If header: a lock token or an entity tag.
+type ifCondition struct {
+	not   bool
+	token string
+	etag  string
+}
+
+// ifList is a list of conditions of the If header, which must all be true. It
+// applies to the tagged resource or else to the resource of the request.
+type ifList struct {
+	resource string // clean URL path
+	conds    []ifCondition
+}
+
+// parseIf parses the If header (RFC 4918 section 10.4).
+func parseIf(header string) ([]ifList, error) {
+	var lists []ifList
+	resource := ""
+	s := strings.TrimSpace(header)
+	for s != "" {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, errInvalidRequest
+			}
+			u, err := url.Parse(s[1:end])
+			if err != nil {
+				return nil, errInvalidRequest
+			}
+			resource = path.Clean("/" + u.Path)
+			s = s[end+1:]
+
+		case '(':
+			end := strings.IndexByte(s, ')')
+			if end < 0 {
+				return nil, errInvalidRequest
+			}
+			conds, err := parseIfConditions(s[1:end])
+			if err != nil {
+				return nil, err
+			}
+			lists = append(lists, ifList{resource: resource, conds: conds})
+			s = s[end+1:]
+
+		default:
+			return nil, errInvalidRequest
+		}
+		s = strings.TrimSpace(s)
+	}
+	if len(lists) == 0 {
+		return nil, errInvalidRequest
+	}
+	return lists, nil
+}
+
+// parseIfConditions parses the conditions of a list of the If header.
+func parseIfConditions(s string) ([]ifCondition, error) {
+	var conds []ifCondition
+	not := false
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var closing byte
+		switch {
+		case strings.HasPrefix(s, "Not"):
+			not = true
+			s = s[3:]
+			continue
+		case s[0] == '<':
+			closing = '>'
+		case s[0] == '[':
+			closing = ']'
+		default:
+			return nil, errInvalidRequest
+		}
+		end := strings.IndexByte(s, closing)
+		if end < 0 {
+			return nil, errInvalidRequest
+		}
+		c := ifCondition{not: not}
+		if closing == '>' {
+			c.token = s[1:end]
+		} else {
+			c.etag = strings.TrimPrefix(s[1:end], "W/")
+		}
+		conds = append(conds, c)
+		not = false
+		s = s[end+1:]
+	}
+	if len(conds) == 0 {
+		return nil, errInvalidRequest
+	}
+	return conds, nil
+}
+
+// etagOf returns the entity tag of the resource of the URL path, or an empty
+// string if it does not exist.
+func etagOf(urlPath string) string {
+	rt, name, ok := lookupRoute(urlPath)
+	if !ok {
+		return ""
+	}
+	p, err := rt.dir.resolve(name)
+	if err != nil {
+		return ""
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ""
+	}
+	return etag(fi)
+}
+
+// holds returns true if the conditions of the list are true.
+func (l *ifList) holds() bool {
+	for _, c := range l.conds {
+		var ok bool
+		if c.token != "" {
+			lock, found := locks.lookup(c.token)
+			ok = found && lock.covers(l.resource)
+		} else {
+			ok = c.etag == etagOf(l.resource)
+		}
+		if ok == c.not {
+			return false
+		}
+	}
+	return true
+}
+
+// submittedTokens returns the lock tokens of the If header of the request.
+func submittedTokens(r *http.Request) map[string]bool {
+	tokens := make(map[string]bool)
+	lists, err := parseIf(r.Header.Get("If"))
+	if err != nil {
+		return tokens
+	}
+	for _, l := range lists {
+		for _, c := range l.conds {
+			if c.token != "" && !c.not {
+				tokens[c.token] = true
+			}
+		}
+	}
+	return tokens
+}
+
+// checkIf evaluates the If header of the request, if any: one of its lists must
+// be true.
+func checkIf(r *http.Request) error {
+	header := r.Header.Get("If")
+	if header == "" {
+		return nil
+	}
+	lists, err := parseIf(header)
+	if err != nil {
+		return err
+	}
+	for i := range lists {
+		if lists[i].resource == "" {
+			lists[i].resource = path.Clean(r.URL.Path)
+		}
+		if lists[i].holds() {
+			return nil
+		}
+	}
+	return errPrecondition
+}
+
+// checkLocks returns errLocked if the resource of the URL path (and its members
+// if descendants is true) is locked and the If header of the request does not
+// submit the token of each exclusive lock and of one of the shared locks.
+func checkLocks(r *http.Request, urlPath string, descendants bool) error {
+	conflicts := locks.conflicting(urlPath, descendants)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	tokens := submittedTokens(r)
+	shared, sharedSubmitted := false, false
+	for _, l := range conflicts {
+		switch {
+		case l.exclusive && !tokens[l.token]:
+			return errLocked
+		case !l.exclusive:
+			shared = true
+			sharedSubmitted = sharedSubmitted || tokens[l.token]
+		}
+	}
+	if shared && !sharedSubmitted {
+		return errLocked
+	}
+	return nil
+}
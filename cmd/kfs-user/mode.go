@@ -0,0 +1,55 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+)
+
+// Access modes of routes.
+const (
+	modeReadOnly   = "ro"
+	modeReadWrite  = "rw"
+	modeNoDelete   = "no-delete"
+	modeAppendOnly = "append-only"
+)
+
+// Operations on files.
+const (
+	opCreate  = 1 << iota // create a file or directory
+	opReplace             // replace the content of a file
+	opDelete              // remove a file or directory (including moves and overwrites)
+)
+
+// Operations allowed by each access mode. Reading is always allowed.
+var modeOperations = map[string]int{
+	modeReadOnly:   0,
+	modeReadWrite:  opCreate | opReplace | opDelete,
+	modeNoDelete:   opCreate | opReplace,
+	modeAppendOnly: opCreate,
+}
+
+// errAccessMode is returned for operations not allowed by the access mode of
+// the route.
+var errAccessMode = errors.New("operation not allowed by the access mode of the route")
+
+// allows returns true if the access mode of the route allows the operations.
+func (rt *route) allows(ops int) bool {
+	return modeOperations[rt.mode]&ops == ops
+}
+
+// check returns errAccessMode if the access mode of the route does not allow
+// the operations.
+func (rt *route) check(ops int) error {
+	if !rt.allows(ops) {
+		return errAccessMode
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cea-hpc/kfs"
+)
+
+// Routes of the server, longest patterns first.
+var routes []*route
+
+// addRoute registers the route.
+func addRoute(rt *route) {
+	routes = append(routes, rt)
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].pattern) > len(routes[j].pattern) })
+	http.Handle(rt.pattern, rt)
+}
+
+// lookupRoute returns the route serving the URL path and the path relative to
+// the route, like http.ServeMux does.
+func lookupRoute(urlPath string) (*route, string, bool) {
+	urlPath = path.Clean("/" + urlPath)
+	for _, rt := range routes {
+		if strings.HasPrefix(urlPath+"/", rt.pattern) {
+			return rt, strings.TrimSuffix(strings.TrimPrefix(urlPath+"/", rt.pattern), "/"), true
+		}
+	}
+	return nil, "", false
+}
+
+// resolveEntry returns the canonical path of the parent directory of name
+// followed by its base name: contrary to limitDir.resolve, the last component
+// of name is not followed if it is a symbolic link. The entry may not exist:
+// it is then only hidden if it is excluded (see pathFilter).
+func (rt *route) resolveEntry(name string) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "", errRouteRoot
+	}
+	base := path.Base(name)
+	if !validName(base) {
+		return "", errInvalidName
+	}
+	dir, err := rt.resolveDir(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, base)
+	if _, err := os.Lstat(p); err == nil && rt.dir.hiddenPath(p) {
+		return "", errHidden
+	}
+	if err := rt.dir.checkNew(p, true); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// destinationPath returns the clean URL path of the destination of a move or
+// a copy. dest is a URL path or an absolute URL.
+func destinationPath(dest string) (string, error) {
+	if strings.Contains(dest, "://") {
+		u, err := url.Parse(dest)
+		if err != nil {
+			return "", errInvalidRequest
+		}
+		dest = u.Path
+	}
+	if !strings.HasPrefix(dest, "/") {
+		return "", errInvalidRequest
+	}
+	return path.Clean(dest), nil
+}
+
+// resolveDestination returns the route of the URL path of a destination, which
+// may be in another route, and the path returned by resolveEntry.
+func resolveDestination(destURLPath string) (*route, string, error) {
+	rt, name, ok := lookupRoute(destURLPath)
+	if !ok {
+		return nil, "", errOutside
+	}
+	dest, err := rt.resolveEntry(name)
+	if os.IsNotExist(err) || err == errNotDir {
+		return nil, "", errNoParent
+	}
+	return rt, dest, err
+}
+
+// errTokenRoutes is returned for destinations outside of the routes of the
+// personal API token of the request.
+var errTokenRoutes = errors.New("destination outside of the routes of the token")
+
+// allowedDestination returns true if the request can write to the URL path:
+// requests of personal API tokens are limited to the routes of the token.
+func allowedDestination(r *http.Request, urlPath string) bool {
+	header := r.Header.Get(kfs.TokenRoutesHeader)
+	if header == "" {
+		return true
+	}
+	for _, route := range strings.Split(header, ",") {
+		if route == "/" || isInside(urlPath, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// boolParam returns the value of the boolean form parameter (false if it is
+// not set).
+func boolParam(r *http.Request, name string) (bool, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errInvalidRequest
+	}
+	return b, nil
+}
+
+// isInside returns true if the path is the directory dir or is in it.
+func isInside(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// prepareDestination checks that src can be moved or copied to dest. If dest
+// exists, it is removed if overwrite is true. It returns true if dest was
+// removed.
+func prepareDestination(src, dest string, overwrite bool) (bool, error) {
+	if src == dest {
+		return false, errSameFile
+	}
+	if isInside(dest, src) {
+		return false, errInside
+	}
+
+	if _, err := os.Lstat(dest); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !overwrite {
+		return false, errExists
+	}
+	if isInside(src, dest) {
+		// Removing dest would remove src.
+		return false, errInside
+	}
+	return true, os.RemoveAll(dest)
+}
+
+// copyTree copies the file, directory or symbolic link src to dest, which
+// must not exist. Symbolic links are copied as is; other special files are
+// skipped.
+func copyTree(src, dest string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, _, err := writeFile(filepath.Dir(dest), filepath.Base(dest), f, true); err != nil {
+			return err
+		}
+		return os.Chmod(dest, fi.Mode().Perm())
+
+	case fi.IsDir():
+		// The directory must be writable while it is filled.
+		if err := os.Mkdir(dest, 0700); err != nil {
+			return err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := copyTree(filepath.Join(src, name), filepath.Join(dest, name)); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(dest, fi.Mode().Perm())
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dest)
+
+	default:
+		fmt.Printf("INFO: not copying special file %s\n", src)
+		return nil
+	}
+}
+
+// copyDir copies the directory src to dest, which must not exist, without its
+// content. Other files are copied with copyTree.
+func copyDir(src, dest string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return copyTree(src, dest)
+	}
+	if err := os.Mkdir(dest, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(dest, fi.Mode().Perm())
+}
+
+// moveTree moves src to dest, which must not exist. Trees are copied then
+// removed when they are moved to another file system.
+func moveTree(src, dest string) error {
+	err := os.Rename(src, dest)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	if err := copyTree(src, dest); err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// serveDelete removes the file, or the directory if it is empty or if the
+// recursive parameter is true or the Depth header is infinity.
+func (rt *route) serveDelete(w http.ResponseWriter, r *http.Request) {
+	if err := rt.check(opDelete); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	recursive, err := boolParam(r, "recursive")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// WebDAV clients remove directories with their content.
+	recursive = recursive || r.Header.Get("Depth") == "infinity"
+
+	p, err := rt.resolveEntry(rt.name(r))
+	if err == nil {
+		_, err = os.Lstat(p)
+	}
+	if err == nil && recursive && rt.dir.hasHidden(p) {
+		err = errHiddenInside
+	}
+	if err == nil {
+		err = checkLocks(r, path.Clean(r.URL.Path), true)
+	}
+	if err == nil {
+		if recursive {
+			err = os.RemoveAll(p)
+		} else {
+			err = os.Remove(p)
+		}
+	}
+	if err != nil {
+		fmt.Printf("ERROR: deleting %s: %v\n", r.URL.Path, err)
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("INFO: deleted %s\n", p)
+	locks.removeTree(path.Clean(r.URL.Path))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// transfer moves or copies the entry of the request to the destination (see
+// destinationPath). An existing destination is replaced if overwrite is true.
+// If shallow is true, the content of a copied directory is not copied. It
+// returns true if the destination was replaced.
+func (rt *route) transfer(r *http.Request, op, destination string, overwrite, shallow bool) (bool, error) {
+	src, err := rt.resolveEntry(rt.name(r))
+	if err != nil {
+		return false, err
+	}
+	if op == "move" {
+		// The source is removed.
+		if err := rt.check(opDelete); err != nil {
+			return false, err
+		}
+	}
+	destURLPath, err := destinationPath(destination)
+	if err != nil {
+		return false, err
+	}
+	if !allowedDestination(r, destURLPath) {
+		return false, errTokenRoutes
+	}
+	destRt, dest, err := resolveDestination(destURLPath)
+	if err != nil {
+		return false, err
+	}
+	if err := destRt.check(opCreate); err != nil {
+		return false, err
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return false, err
+	}
+	if overwrite && !destRt.allows(opDelete) {
+		if _, err := os.Lstat(dest); err == nil {
+			return false, errAccessMode
+		}
+	}
+	// Hidden entries must stay hidden.
+	if err := destRt.dir.checkNew(dest, fi.IsDir()); err != nil {
+		return false, err
+	}
+	if rt.dir.hasHidden(src) || (overwrite && destRt.dir.hasHidden(dest)) {
+		return false, errHiddenInside
+	}
+
+	if op == "move" {
+		if err := checkLocks(r, path.Clean(r.URL.Path), true); err != nil {
+			return false, err
+		}
+	}
+	if err := checkLocks(r, destURLPath, true); err != nil {
+		return false, err
+	}
+
+	replaced, err := prepareDestination(src, dest, overwrite)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case op == "move":
+		err = moveTree(src, dest)
+		if err == nil {
+			locks.removeTree(path.Clean(r.URL.Path))
+		}
+	case shallow:
+		err = copyDir(src, dest)
+	default:
+		err = copyTree(src, dest)
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("INFO: %s %s to %s\n", op, src, dest)
+	return replaced, nil
+}
+
+// serveOp runs the file operation requested with the op parameter of a POST
+// request: mkdir, move, copy or archive (see serveSelection).
+func (rt *route) serveOp(w http.ResponseWriter, r *http.Request) {
+	op := r.FormValue("op")
+	if op == "archive" {
+		rt.serveSelection(w, r)
+		return
+	}
+	overwrite, err := boolParam(r, "overwrite")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	switch op {
+	case "mkdir":
+		err = rt.mkdir(r)
+
+	case "move", "copy":
+		var replaced bool
+		replaced, err = rt.transfer(r, op, r.FormValue("destination"), overwrite, false)
+		if replaced {
+			status = http.StatusNoContent
+		}
+
+	default:
+		err = errInvalidRequest
+	}
+
+	if err != nil {
+		fmt.Printf("ERROR: %s %s: %v\n", op, r.URL.Path, err)
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// mkdir creates the directory of the request.
+func (rt *route) mkdir(r *http.Request) error {
+	if err := rt.check(opCreate); err != nil {
+		return err
+	}
+	dir, err := rt.resolveEntry(rt.name(r))
+	if os.IsNotExist(err) || err == errNotDir {
+		return errNoParent
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkLocks(r, path.Clean(r.URL.Path), false); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return err
+	}
+	fmt.Printf("INFO: created directory %s\n", dir)
+	return nil
+}
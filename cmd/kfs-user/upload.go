@@ -0,0 +1,314 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Errors of requests modifying files.
+var (
+	errExists         = errors.New("file already exists")
+	errInvalidName    = errors.New("invalid file name")
+	errInvalidRequest = errors.New("invalid request")
+	errIsDir          = errors.New("is a directory")
+	errNotDir         = errors.New("not a directory")
+	errNotRegular     = errors.New("not a regular file")
+	errNoParent       = errors.New("parent directory does not exist")
+	errRouteRoot      = errors.New("exported directory cannot be modified")
+	errSameFile       = errors.New("source and destination are the same")
+	errInside         = errors.New("destination is inside the source")
+)
+
+// umask is the file mode creation mask of the process, used for the mode of
+// uploaded files.
+var umask = func() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}()
+
+// validName returns true if name can be used as a file name in a directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// etag returns the entity tag of the file, computed from its modification time
+// and size.
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// noOverwrite returns true if the request asks not to replace existing files
+// with the If-None-Match: * header.
+func noOverwrite(r *http.Request) bool {
+	return strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+}
+
+// exclusive returns true if existing files must not be replaced: if the
+// request has the If-None-Match: * header or if the access mode of the route
+// does not allow it.
+func (rt *route) exclusive(r *http.Request) bool {
+	return noOverwrite(r) || !rt.allows(opReplace)
+}
+
+// writeFile writes the content of the file name in the directory dir (a
+// canonical path): the content is written to a temporary file in the
+// directory which is then renamed, so that the file is replaced atomically.
+// If exclusive is true, an existing file is not replaced and errExists is
+// returned. It returns true if the file was created.
+func writeFile(dir, name string, content io.Reader, exclusive bool) (bool, os.FileInfo, error) {
+	if !validName(name) {
+		return false, nil, errInvalidName
+	}
+	dest := filepath.Join(dir, name)
+
+	created := true
+	mode := 0666 &^ umask
+	if fi, err := os.Lstat(dest); err == nil {
+		switch {
+		case exclusive:
+			return false, nil, errExists
+		case fi.IsDir():
+			return false, nil, errIsDir
+		case fi.Mode().IsRegular():
+			mode = fi.Mode().Perm()
+		}
+		created = false
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".kfs-upload-")
+	if err != nil {
+		return false, nil, err
+	}
+	defer os.Remove(tmp.Name()) // does nothing once renamed
+
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		return false, nil, err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return false, nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, nil, err
+	}
+
+	if exclusive {
+		// Unlike rename, link does not replace an existing file.
+		if err := os.Link(tmp.Name(), dest); err != nil {
+			if os.IsExist(err) {
+				return false, nil, errExists
+			}
+			return false, nil, err
+		}
+	} else if err := os.Rename(tmp.Name(), dest); err != nil {
+		return false, nil, err
+	}
+
+	fi, err := os.Stat(dest)
+	if err != nil {
+		return false, nil, err
+	}
+	return created, fi, nil
+}
+
+// writeError replies to a request modifying files with the HTTP status
+// matching the error.
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errExists, err == errPrecondition:
+		http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+	case err == errLocked:
+		http.Error(w, "423 Locked", http.StatusLocked)
+	case err == errInvalidName, err == errInvalidRequest:
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+	case err == errRouteRoot, err == errSameFile, err == errHiddenInside, err == errAccessMode, err == errTokenRoutes:
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	case err == errIsDir, err == errNotDir, err == errNotRegular, err == errNoParent, err == errInside, os.IsExist(err):
+		// os.IsExist is also true for non-empty directories.
+		http.Error(w, "409 Conflict", http.StatusConflict)
+	default:
+		httpError(w, err)
+	}
+}
+
+// resolveDir returns the canonical path of the directory name of the route.
+func (rt *route) resolveDir(name string) (string, error) {
+	dir, err := rt.dir.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", errNotDir
+	}
+	return dir, nil
+}
+
+// servePut writes the body of the request to the file.
+func (rt *route) servePut(w http.ResponseWriter, r *http.Request) {
+	name := rt.name(r)
+	if name == "" || strings.HasSuffix(name, "/") {
+		writeError(w, errInvalidName)
+		return
+	}
+
+	if err := rt.check(opCreate); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	dir, err := rt.resolveDir(path.Dir(name))
+	if os.IsNotExist(err) || err == errNotDir {
+		err = errNoParent
+	}
+	if err == nil {
+		err = rt.dir.checkNew(filepath.Join(dir, path.Base(name)), false)
+	}
+	if err == nil {
+		err = checkLocks(r, path.Clean(r.URL.Path), false)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	exclusive := rt.exclusive(r)
+	if exclusive && !noOverwrite(r) && lockCreated(r, filepath.Join(dir, path.Base(name))) {
+		exclusive = false
+	}
+	created, fi, err := writeFile(dir, path.Base(name), r.Body, exclusive)
+	if err == errExists && !noOverwrite(r) {
+		err = errAccessMode
+	}
+	if err != nil {
+		fmt.Printf("ERROR: writing %s: %v\n", r.URL.Path, err)
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("INFO: wrote %s (%d bytes)\n", filepath.Join(dir, fi.Name()), fi.Size())
+
+	w.Header().Set("ETag", etag(fi))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// isMultipart returns true if the body of the request is multipart/form-data.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// serveUpload writes the files of a multipart/form-data request to the
+// directory. Browsers are redirected to the directory page.
+func (rt *route) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if err := rt.check(opCreate); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	dir, err := rt.resolveDir(rt.name(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	exclusive := rt.exclusive(r)
+	created := false
+	var last os.FileInfo
+	nfiles := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			// Not a file.
+			part.Close()
+			continue
+		}
+
+		// Some browsers send the full path of the file.
+		name := path.Base(strings.Replace(part.FileName(), "\\", "/", -1))
+		err = rt.dir.checkNew(filepath.Join(dir, name), false)
+		if err == nil {
+			err = checkLocks(r, path.Join(r.URL.Path, name), false)
+		}
+		if err != nil {
+			part.Close()
+			writeError(w, err)
+			return
+		}
+		c, fi, err := writeFile(dir, name, part, exclusive)
+		part.Close()
+		if err == errExists && !noOverwrite(r) {
+			err = errAccessMode
+		}
+		if err != nil {
+			fmt.Printf("ERROR: writing %s in %s: %v\n", name, dir, err)
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("INFO: wrote %s (%d bytes)\n", filepath.Join(dir, fi.Name()), fi.Size())
+		created = created || c
+		last = fi
+		nfiles++
+	}
+
+	if nfiles == 0 {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	if nfiles == 1 {
+		w.Header().Set("ETag", etag(last))
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,584 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAV methods (RFC 4918).
+const (
+	methodPropfind  = "PROPFIND"
+	methodProppatch = "PROPPATCH"
+	methodMkcol     = "MKCOL"
+	methodCopy      = "COPY"
+	methodMove      = "MOVE"
+	methodLock      = "LOCK"
+	methodUnlock    = "UNLOCK"
+)
+
+// allowedMethods is the value of the Allow header.
+const allowedMethods = "OPTIONS, GET, HEAD, PUT, POST, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+
+// Maximum size of XML request bodies.
+const maxXMLBody = 1 << 20
+
+// Live properties of resources, in the DAV: namespace.
+var liveProperties = []string{
+	"resourcetype",
+	"displayname",
+	"getcontentlength",
+	"getcontenttype",
+	"getlastmodified",
+	"creationdate",
+	"getetag",
+	"supportedlock",
+	"lockdiscovery",
+}
+
+// propNames are the names of the properties of a prop element.
+type propNames []xml.Name
+
+// UnmarshalXML collects the names of the child elements.
+func (p *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			*p = append(*p, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// propfindRequest is the body of a PROPFIND request.
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     propNames `xml:"DAV: prop"`
+}
+
+// proppatchRequest is the body of a PROPPATCH request.
+type proppatchRequest struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+	Remove []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: remove"`
+}
+
+// lockRequest is the body of a LOCK request.
+type lockRequest struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     struct {
+		Href string `xml:"DAV: href"`
+		Text string `xml:",chardata"`
+	} `xml:"DAV: owner"`
+}
+
+// readXML decodes the XML body of the request. It returns false if the body is
+// empty.
+func readXML(r *http.Request, v interface{}) (bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxXMLBody))
+	if err != nil {
+		return false, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false, nil
+	}
+	if err := xml.Unmarshal(body, v); err != nil {
+		return false, errInvalidRequest
+	}
+	return true, nil
+}
+
+// xmlEscape returns the text escaped for XML.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// propElement returns an empty element of the property name.
+func propElement(name xml.Name) string {
+	switch name.Space {
+	case "DAV:":
+		return "<D:" + name.Local + "/>"
+	case "":
+		return "<" + name.Local + "/>"
+	}
+	return fmt.Sprintf(`<x:%s xmlns:x="%s"/>`, name.Local, xmlEscape(name.Space))
+}
+
+// href returns the escaped URL path of a resource.
+func href(urlPath string, isDir bool) string {
+	if isDir && !strings.HasSuffix(urlPath, "/") {
+		urlPath += "/"
+	}
+	return xmlEscape((&url.URL{Path: urlPath}).EscapedPath())
+}
+
+// activeLock returns the activelock element of the lock.
+func activeLock(l *davLock) string {
+	var b strings.Builder
+	b.WriteString("<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope>")
+	if l.exclusive {
+		b.WriteString("<D:exclusive/>")
+	} else {
+		b.WriteString("<D:shared/>")
+	}
+	b.WriteString("</D:lockscope><D:depth>")
+	if l.infinite {
+		b.WriteString("infinity")
+	} else {
+		b.WriteString("0")
+	}
+	b.WriteString("</D:depth>")
+	if l.owner != "" {
+		fmt.Fprintf(&b, "<D:owner>%s</D:owner>", l.owner)
+	}
+	fmt.Fprintf(&b, "<D:timeout>Second-%d</D:timeout>", int(l.timeout/time.Second))
+	fmt.Fprintf(&b, "<D:locktoken><D:href>%s</D:href></D:locktoken>", xmlEscape(l.token))
+	fmt.Fprintf(&b, "<D:lockroot><D:href>%s</D:href></D:lockroot>", href(l.root, false))
+	b.WriteString("</D:activelock>")
+	return b.String()
+}
+
+// lockDiscovery returns the value of the lockdiscovery property of the URL
+// path.
+func lockDiscovery(urlPath string) string {
+	var b strings.Builder
+	for _, l := range locks.covering(urlPath) {
+		b.WriteString(activeLock(&l))
+	}
+	return b.String()
+}
+
+// liveProperty returns the value of the live property of the resource, and
+// false if the resource does not have the property.
+func liveProperty(name string, urlPath string, fi os.FileInfo) (string, bool) {
+	switch name {
+	case "resourcetype":
+		if fi.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		return xmlEscape(path.Base(urlPath)), true
+	case "getcontentlength":
+		if fi.IsDir() {
+			return "", false
+		}
+		return strconv.FormatInt(fi.Size(), 10), true
+	case "getcontenttype":
+		if fi.IsDir() {
+			return "", false
+		}
+		ctype := mime.TypeByExtension(filepath.Ext(fi.Name()))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		return xmlEscape(ctype), true
+	case "getlastmodified":
+		return fi.ModTime().UTC().Format(http.TimeFormat), true
+	case "creationdate":
+		// The creation time is unknown: use the modification time.
+		return fi.ModTime().UTC().Format(time.RFC3339), true
+	case "getetag":
+		if fi.IsDir() {
+			return "", false
+		}
+		return xmlEscape(etag(fi)), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		return lockDiscovery(urlPath), true
+	}
+	return "", false
+}
+
+// multistatus builds the body of a 207 Multi-Status answer.
+type multistatus struct {
+	b strings.Builder
+}
+
+func newMultistatus() *multistatus {
+	ms := &multistatus{}
+	ms.b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	return ms
+}
+
+// propstat adds a propstat element with the (already encoded) properties.
+func (ms *multistatus) propstat(props []string, status int) {
+	if len(props) == 0 {
+		return
+	}
+	ms.b.WriteString("<D:propstat><D:prop>")
+	for _, p := range props {
+		ms.b.WriteString(p)
+	}
+	fmt.Fprintf(&ms.b, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>", status, http.StatusText(status))
+}
+
+// write sends the answer.
+func (ms *multistatus) write(w http.ResponseWriter) {
+	ms.b.WriteString("</D:multistatus>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, ms.b.String())
+}
+
+// addResource adds the response with the properties of the resource.
+func (ms *multistatus) addResource(req *propfindRequest, urlPath string, fi os.FileInfo) {
+	fmt.Fprintf(&ms.b, "<D:response><D:href>%s</D:href>", href(urlPath, fi.IsDir()))
+
+	var found, missing []string
+	switch {
+	case req.PropName != nil:
+		for _, name := range liveProperties {
+			if _, ok := liveProperty(name, urlPath, fi); ok {
+				found = append(found, "<D:"+name+"/>")
+			}
+		}
+	case len(req.Prop) != 0:
+		for _, name := range req.Prop {
+			if name.Space == "DAV:" {
+				if value, ok := liveProperty(name.Local, urlPath, fi); ok {
+					found = append(found, fmt.Sprintf("<D:%s>%s</D:%s>", name.Local, value, name.Local))
+					continue
+				}
+			}
+			missing = append(missing, propElement(name))
+		}
+	default: // allprop
+		for _, name := range liveProperties {
+			if value, ok := liveProperty(name, urlPath, fi); ok {
+				found = append(found, fmt.Sprintf("<D:%s>%s</D:%s>", name, value, name))
+			}
+		}
+	}
+	ms.propstat(found, http.StatusOK)
+	ms.propstat(missing, http.StatusNotFound)
+
+	ms.b.WriteString("</D:response>")
+}
+
+// davError replies to a WebDAV request with the HTTP status matching the
+// error.
+func davError(w http.ResponseWriter, r *http.Request, err error) {
+	fmt.Printf("ERROR: %s %s: %v\n", r.Method, r.URL.Path, err)
+	writeError(w, err)
+}
+
+// serveOptions announces the support of WebDAV.
+func (rt *route) serveOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", allowedMethods)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+}
+
+// servePropfind replies with the properties of the resource and, with Depth:
+// 1, of its members. Depth: infinity is not supported.
+func (rt *route) servePropfind(w http.ResponseWriter, r *http.Request) {
+	depth := r.Header.Get("Depth")
+	switch depth {
+	case "0", "1":
+	default:
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`+"\n")
+		return
+	}
+
+	req := &propfindRequest{}
+	if _, err := readXML(r, req); err != nil {
+		davError(w, r, err)
+		return
+	}
+
+	p, err := rt.dir.resolve(rt.name(r))
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(p)
+	}
+	if err != nil {
+		davError(w, r, err)
+		return
+	}
+
+	urlPath := path.Clean(r.URL.Path)
+	ms := newMultistatus()
+	ms.addResource(req, urlPath, fi)
+
+	if depth == "1" && fi.IsDir() {
+		entries, err := rt.dir.readDirEntries(p)
+		if err != nil {
+			davError(w, r, err)
+			return
+		}
+		for _, e := range entries {
+			child, err := os.Stat(filepath.Join(p, e.Name))
+			if err != nil {
+				// Dangling symbolic link.
+				continue
+			}
+			ms.addResource(req, path.Join(urlPath, e.Name), child)
+		}
+	}
+
+	ms.write(w)
+}
+
+// serveProppatch refuses to modify properties: live properties are protected
+// and dead properties are not stored.
+func (rt *route) serveProppatch(w http.ResponseWriter, r *http.Request) {
+	req := &proppatchRequest{}
+	ok, err := readXML(r, req)
+	if err == nil && !ok {
+		err = errInvalidRequest
+	}
+	var fi os.FileInfo
+	if err == nil {
+		var p string
+		p, err = rt.dir.resolve(rt.name(r))
+		if err == nil {
+			fi, err = os.Stat(p)
+		}
+	}
+	if err == nil {
+		err = checkLocks(r, path.Clean(r.URL.Path), false)
+	}
+	if err != nil {
+		davError(w, r, err)
+		return
+	}
+
+	var props []string
+	for _, set := range req.Set {
+		for _, name := range set.Prop {
+			props = append(props, propElement(name))
+		}
+	}
+	for _, remove := range req.Remove {
+		for _, name := range remove.Prop {
+			props = append(props, propElement(name))
+		}
+	}
+
+	ms := newMultistatus()
+	fmt.Fprintf(&ms.b, "<D:response><D:href>%s</D:href>", href(path.Clean(r.URL.Path), fi.IsDir()))
+	ms.propstat(props, http.StatusForbidden)
+	ms.b.WriteString("</D:response>")
+	ms.write(w)
+}
+
+// serveMkcol creates a collection.
+func (rt *route) serveMkcol(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > 0 {
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err := rt.mkdir(r)
+	if os.IsExist(err) {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		davError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveCopyMove copies or moves the resource to the Destination header.
+func (rt *route) serveCopyMove(w http.ResponseWriter, r *http.Request) {
+	op := "copy"
+	if r.Method == methodMove {
+		op = "move"
+	}
+
+	overwrite := true
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		davError(w, r, errInvalidRequest)
+		return
+	}
+
+	shallow := false
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		shallow = op == "copy"
+	default:
+		davError(w, r, errInvalidRequest)
+		return
+	}
+
+	destination := r.Header.Get("Destination")
+	if destination == "" {
+		davError(w, r, errInvalidRequest)
+		return
+	}
+
+	replaced, err := rt.transfer(r, op, destination, overwrite, shallow)
+	if err != nil {
+		davError(w, r, err)
+		return
+	}
+	if replaced {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// serveLock creates or refreshes a lock. A missing resource is created empty.
+// Locks are only given in routes where files can be written.
+func (rt *route) serveLock(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean(r.URL.Path)
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	if err := rt.check(opCreate); err != nil {
+		davError(w, r, err)
+		return
+	}
+
+	req := &lockRequest{}
+	ok, err := readXML(r, req)
+	if err != nil {
+		davError(w, r, err)
+		return
+	}
+
+	var l davLock
+	status := http.StatusOK
+	if !ok {
+		// Refresh of the lock submitted in the If header.
+		err = errPrecondition
+		for token := range submittedTokens(r) {
+			if l, err = locks.refresh(token, urlPath, timeout); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			davError(w, r, err)
+			return
+		}
+	} else {
+		if req.Write == nil || (req.Exclusive == nil) == (req.Shared == nil) {
+			davError(w, r, errInvalidRequest)
+			return
+		}
+		nl := &davLock{
+			root:      urlPath,
+			infinite:  true,
+			exclusive: req.Exclusive != nil,
+			timeout:   timeout,
+		}
+		switch r.Header.Get("Depth") {
+		case "", "infinity":
+		case "0":
+			nl.infinite = false
+		default:
+			davError(w, r, errInvalidRequest)
+			return
+		}
+		if req.Owner.Href != "" {
+			nl.owner = "<D:href>" + xmlEscape(strings.TrimSpace(req.Owner.Href)) + "</D:href>"
+		} else {
+			nl.owner = xmlEscape(strings.TrimSpace(req.Owner.Text))
+		}
+
+		p, err := rt.resolveEntry(rt.name(r))
+		if err == errRouteRoot {
+			p, err = rt.dir.dir, nil
+		}
+		if err != nil {
+			davError(w, r, err)
+			return
+		}
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			// Lock of an unmapped URL: an empty file is created.
+			err = rt.dir.checkNew(p, false)
+			if err == nil {
+				err = checkLocks(r, urlPath, false)
+			}
+			if err == nil {
+				_, _, err = writeFile(filepath.Dir(p), filepath.Base(p), strings.NewReader(""), true)
+			}
+			if err != nil {
+				davError(w, r, err)
+				return
+			}
+			status = http.StatusCreated
+			nl.created = p
+		}
+
+		if err := locks.create(nl); err != nil {
+			davError(w, r, err)
+			return
+		}
+		l = *nl
+		w.Header().Set("Lock-Token", "<"+l.token+">")
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>`+"\n", activeLock(&l))
+}
+
+// serveUnlock removes the lock of the Lock-Token header.
+func (rt *route) serveUnlock(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		davError(w, r, errInvalidRequest)
+		return
+	}
+	token = token[1 : len(token)-1]
+
+	if !locks.remove(token, path.Clean(r.URL.Path)) {
+		fmt.Printf("ERROR: UNLOCK %s: no lock %s\n", r.URL.Path, token)
+		http.Error(w, "409 Conflict", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
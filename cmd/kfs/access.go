@@ -0,0 +1,154 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Login shells of accounts which are not allowed to log in.
+var deniedShells = map[string]bool{
+	"nologin": true,
+	"false":   true,
+}
+
+// accessRules defines which users are allowed to use the server. Deny lists
+// take precedence over allow lists. If any allow list is defined, the user
+// must match at least one entry of them.
+type accessRules struct {
+	AllowUsers  []string `yaml:"allow_users"`  // allowed logins
+	DenyUsers   []string `yaml:"deny_users"`   // denied logins
+	AllowGroups []string `yaml:"allow_groups"` // allowed UNIX groups
+	DenyGroups  []string `yaml:"deny_groups"`  // denied UNIX groups
+	AllowRealms []string `yaml:"allow_realms"` // allowed Kerberos realms
+	DenyRealms  []string `yaml:"deny_realms"`  // denied Kerberos realms
+	MinUID      int      `yaml:"min_uid"`      // minimum UID of users
+	CheckShell  bool     `yaml:"check_shell"`  // deny users with a nologin shell
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// userGroups returns the names of the groups the user is a member of.
+func userGroups(userInfo *user.User) ([]string, error) {
+	gids, err := userInfo.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		group, err := user.LookupGroupId(gid)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group.Name)
+	}
+
+	return groups, nil
+}
+
+// userShell returns the login shell of the user as known by the name service
+// switch.
+func userShell(username string) (string, error) {
+	out, err := exec.Command("getent", "passwd", username).Output()
+	if err != nil {
+		return "", fmt.Errorf("getent passwd %s: %v", username, err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(fields) != 7 {
+		return "", fmt.Errorf("invalid passwd entry for %s", username)
+	}
+
+	return fields[6], nil
+}
+
+func (a *accessRules) hasAllowList() bool {
+	return len(a.AllowUsers) != 0 || len(a.AllowGroups) != 0 || len(a.AllowRealms) != 0
+}
+
+// check returns an error describing why the user is denied access or nil if
+// access is granted.
+func (a *accessRules) check(krbusername string, userInfo *user.User) error {
+	if a.MinUID > 0 {
+		uid, err := strconv.Atoi(userInfo.Uid)
+		if err != nil {
+			return fmt.Errorf("invalid UID %s", userInfo.Uid)
+		}
+		if uid < a.MinUID {
+			return fmt.Errorf("UID %d is lower than %d", uid, a.MinUID)
+		}
+	}
+
+	if a.CheckShell {
+		shell, err := userShell(userInfo.Username)
+		if err != nil {
+			return err
+		}
+		if shell == "" || deniedShells[filepath.Base(shell)] {
+			return fmt.Errorf("login shell `%s` is not allowed", shell)
+		}
+	}
+
+	var groups []string
+	if len(a.AllowGroups) != 0 || len(a.DenyGroups) != 0 {
+		var err error
+		if groups, err = userGroups(userInfo); err != nil {
+			return fmt.Errorf("cannot get groups: %v", err)
+		}
+	}
+
+	realm := principalRealm(krbusername)
+
+	if contains(a.DenyUsers, userInfo.Username) {
+		return fmt.Errorf("user is denied")
+	}
+	if contains(a.DenyRealms, realm) {
+		return fmt.Errorf("realm `%s` is denied", realm)
+	}
+	for _, group := range groups {
+		if contains(a.DenyGroups, group) {
+			return fmt.Errorf("group `%s` is denied", group)
+		}
+	}
+
+	if !a.hasAllowList() {
+		return nil
+	}
+
+	if contains(a.AllowUsers, userInfo.Username) || contains(a.AllowRealms, realm) {
+		return nil
+	}
+	for _, group := range groups {
+		if contains(a.AllowGroups, group) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user, groups and realm are not allowed")
+}
+
+// auditAccessDenied records an access denial.
+func auditAccessDenied(krbusername, remoteAddr string, reason error) {
+	log.Printf("AUDIT: access denied: principal=%s remote=%s reason=%q", krbusername, remoteAddr, reason.Error())
+}
@@ -0,0 +1,533 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Credential cache types.
+const (
+	ccacheFile    = "FILE"    // files in a directory
+	ccacheDir     = "DIR"     // DIR collections
+	ccacheKeyring = "KEYRING" // kernel keyrings
+	ccacheKCM     = "KCM"     // Kerberos credential manager
+)
+
+var (
+	defaultCcacheType = ccacheFile
+	defaultCcachePath = map[string]string{
+		ccacheFile:    "/run/kfs/{{UID}}",
+		ccacheDir:     "/run/kfs/{{UID}}/ccache",
+		ccacheKeyring: "persistent:{{UID}}",
+		ccacheKCM:     "",
+	}
+	defaultStagingDir = "/run/kfs/{{UID}}"
+)
+
+// Timeout of the credential cache helper processes.
+const ccacheHelperTimeout = 30 * time.Second
+
+var ccachePatternsRegexp = regexp.MustCompile("{{(UID|USER)}}")
+
+// ccacheConfig defines where user credentials are stored.
+type ccacheConfig struct {
+	Type       string // credential cache type: FILE, DIR, KEYRING or KCM
+	Path       string // directory (FILE and DIR) or residual (KEYRING and KCM) template
+	StagingDir string `yaml:"staging_dir"` // directory template of temporary files (DIR, KEYRING and KCM)
+	krb5Lib    string // Kerberos 5 library used by helper processes
+}
+
+// init sets default values of the credential cache configuration and checks
+// it.
+func (c *ccacheConfig) init(krb5Lib string) error {
+	c.krb5Lib = krb5Lib
+
+	if c.Type == "" {
+		c.Type = defaultCcacheType
+	}
+	c.Type = strings.ToUpper(c.Type)
+	path, ok := defaultCcachePath[c.Type]
+	if !ok {
+		return fmt.Errorf("invalid ccache type: %s", c.Type)
+	}
+	if c.Path == "" {
+		c.Path = path
+	}
+	if c.StagingDir == "" {
+		c.StagingDir = defaultStagingDir
+	}
+
+	dirs := []string{c.StagingDir}
+	if c.Type == ccacheFile || c.Type == ccacheDir {
+		dirs = append(dirs, c.Path)
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("ccache directory %s is not an absolute path", dir)
+		}
+		if !ccachePatternsRegexp.MatchString(dir) {
+			return fmt.Errorf("ccache directory %s must contain {{UID}} or {{USER}}", dir)
+		}
+	}
+	return nil
+}
+
+// expandCcacheTemplate replaces the patterns of the template with the user values.
+func expandCcacheTemplate(template string, userInfo *user.User) string {
+	return ccachePatternsRegexp.ReplaceAllStringFunc(template, func(s string) string {
+		if s == "{{UID}}" {
+			return userInfo.Uid
+		}
+		return userInfo.Username
+	})
+}
+
+// isCollection returns true if credentials are stored in a collection managed
+// by the Kerberos library as the user.
+func (c *ccacheConfig) isCollection() bool {
+	return c.Type != ccacheFile
+}
+
+// collection returns the name of the credential cache collection of the user.
+func (c *ccacheConfig) collection(userInfo *user.User) string {
+	return c.Type + ":" + expandCcacheTemplate(c.Path, userInfo)
+}
+
+// env returns the KRB5CCNAME value to use for the user processes or an empty
+// string if there is none. Files are found by their name (e.g. by rpc.gssd),
+// as a new one is created on each rotation.
+func (c *ccacheConfig) env(userInfo *user.User) string {
+	if !c.isCollection() {
+		return ""
+	}
+	return c.collection(userInfo)
+}
+
+// save stores the credentials written in a FILE credential cache by the write
+// function in a new credential cache of the user. It returns the name of the
+// credential cache or an error if any.
+func (c *ccacheConfig) save(userInfo *user.User, write func(krb5ccname string) error) (string, error) {
+	if !c.isCollection() {
+		dir, err := userCredDir(expandCcacheTemplate(c.Path, userInfo), userInfo)
+		if err != nil {
+			return "", err
+		}
+		krb5ccname, err := writeCredFile(userInfo, dir, write)
+		if err != nil {
+			return "", err
+		}
+		return ccacheFile + ":" + krb5ccname, nil
+	}
+
+	dir, err := userCredDir(expandCcacheTemplate(c.StagingDir, userInfo), userInfo)
+	if err != nil {
+		return "", err
+	}
+	staging, err := writeCredFile(userInfo, dir, write)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(staging)
+
+	if c.Type == ccacheDir {
+		if err := userCollectionDir(expandCcacheTemplate(c.Path, userInfo), userInfo); err != nil {
+			return "", err
+		}
+	}
+
+	return c.helper(userInfo, "store", ccacheFile+":"+staging)
+}
+
+// renew renews the TGT of the credential cache and stores it in a new
+// credential cache replacing the old one. It returns the name of the new
+// credential cache and the expiration time of the renewed TGT.
+func (c *ccacheConfig) renew(userInfo *user.User, krb5ccname string) (string, time.Time, error) {
+	if !c.isCollection() {
+		var endtime time.Time
+		dir := filepath.Dir(strings.TrimPrefix(krb5ccname, ccacheFile+":"))
+		newKrb5ccname, err := writeCredFile(userInfo, dir, func(out string) error {
+			var err error
+			endtime, err = RenewTGT(krb5ccname, ccacheFile+":"+out)
+			return err
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return ccacheFile + ":" + newKrb5ccname, endtime, nil
+	}
+
+	out, err := c.helper(userInfo, "renew", krb5ccname)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", time.Time{}, fmt.Errorf("invalid helper output: %q", out)
+	}
+	endtime, err := parseUnixTime(fields[1])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return fields[0], endtime, nil
+}
+
+// times returns the expiration time of the TGT of the credential cache and,
+// if it is renewable, the time until which it can be renewed (zero
+// otherwise).
+func (c *ccacheConfig) times(userInfo *user.User, krb5ccname string) (time.Time, time.Time, error) {
+	if !c.isCollection() {
+		return TGTTimes(krb5ccname)
+	}
+
+	out, err := c.helper(userInfo, "times", krb5ccname)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid helper output: %q", out)
+	}
+	endtime, err := parseUnixTime(fields[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	renewTill, err := parseUnixTime(fields[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return endtime, renewTill, nil
+}
+
+// remove destroys the credential cache. Credential caches of a previous type
+// can be removed.
+func (c *ccacheConfig) remove(userInfo *user.User, krb5ccname string) error {
+	if strings.HasPrefix(krb5ccname, ccacheFile+":") {
+		return os.Remove(strings.TrimPrefix(krb5ccname, ccacheFile+":"))
+	}
+
+	_, err := c.helper(userInfo, "destroy", krb5ccname)
+	return err
+}
+
+// helper runs the credential cache helper (kfs ccache) as the user with the
+// collection of the user as default credential cache and returns its output.
+func (c *ccacheConfig) helper(userInfo *user.User, args ...string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ccacheHelperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, exe, append([]string{"ccache", c.krb5Lib, c.Type}, args...)...)
+	cmd.Env = []string{
+		"KRB5CCNAME=" + c.collection(userInfo),
+		"HOME=" + userInfo.HomeDir,
+		"USER=" + userInfo.Username,
+		"PATH=/usr/bin:/bin",
+	}
+	cmd.SysProcAttr = userSysProcAttr(userInfo)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("ccache %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("ccache %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseUnixTime parses a time in seconds since the epoch. 0 is the zero time.
+func parseUnixTime(s string) (time.Time, error) {
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(t, 0), nil
+}
+
+// unixTime formats a time in seconds since the epoch. The zero time is 0.
+func unixTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// ccacheCommand is the credential cache helper run as the user by kfs to manage
+// credential caches of collections: kfs ccache LIB TYPE store|renew|times|destroy
+// CCACHE. New credential caches are created in the default collection and made
+// primary. It returns the exit code.
+func ccacheCommand(args []string) int {
+	if len(args) != 4 {
+		fmt.Fprintln(os.Stderr, "usage: kfs ccache LIB TYPE store|renew|times|destroy CCACHE")
+		return 2
+	}
+	krb5Lib, ccacheType, op, ccache := args[0], args[1], args[2], args[3]
+
+	if err := LoadKrb5(krb5Lib); err != nil {
+		fmt.Fprintf(os.Stderr, "loading Kerberos 5 library: %v\n", err)
+		return 1
+	}
+
+	var out string
+	var err error
+	switch op {
+	case "store":
+		var name string
+		if name, err = NewUniqueCcache(ccacheType); err != nil {
+			break
+		}
+		if err = CopyCcache(ccache, name); err == nil {
+			err = SwitchCcache(name)
+		}
+		if err != nil {
+			DestroyCcache(name)
+			break
+		}
+		out = name
+	case "renew":
+		var name string
+		if name, err = NewUniqueCcache(ccacheType); err != nil {
+			break
+		}
+		var endtime time.Time
+		if endtime, err = RenewTGT(ccache, name); err == nil {
+			err = SwitchCcache(name)
+		}
+		if err != nil {
+			DestroyCcache(name)
+			break
+		}
+		out = name + " " + unixTime(endtime)
+	case "times":
+		var endtime, renewTill time.Time
+		if endtime, renewTill, err = TGTTimes(ccache); err == nil {
+			out = unixTime(endtime) + " " + unixTime(renewTill)
+		}
+	case "destroy":
+		err = DestroyCcache(ccache)
+	default:
+		err = fmt.Errorf("unknown operation: %s", op)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if out != "" {
+		fmt.Println(out)
+	}
+	return 0
+}
+
+// checkCredDir returns an error if dir is not a directory (symbolic links are
+// not followed) owned by root and only writable by its owner.
+func checkCredDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Uid != 0 {
+		return fmt.Errorf("%s is not owned by root", dir)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", dir)
+	}
+	return nil
+}
+
+// userCredDir creates if needed the directory storing the credentials files
+// of the user. The directory is owned by root and the group of the user, and
+// only accessible by them. Its parent must be owned by root.
+func userCredDir(dir string, userInfo *user.User) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	if err := checkCredDir(filepath.Dir(dir)); err != nil {
+		return "", err
+	}
+
+	err := os.Mkdir(dir, 0710)
+	switch {
+	case err == nil:
+		gid, _ := strconv.Atoi(userInfo.Gid)
+		if err := os.Lchown(dir, 0, gid); err != nil {
+			return "", err
+		}
+	case !os.IsExist(err):
+		return "", err
+	}
+
+	if err := checkCredDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// userCollectionDir creates if needed the DIR collection of the user. The
+// directory is owned by the user and only accessible by the user. Its parent
+// must be owned by root.
+func userCollectionDir(dir string, userInfo *user.User) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := checkCredDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	uid, _ := strconv.Atoi(userInfo.Uid)
+	gid, _ := strconv.Atoi(userInfo.Gid)
+	err := os.Mkdir(dir, 0700)
+	switch {
+	case err == nil:
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	case !os.IsExist(err):
+		return err
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != uid || fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is not a private directory of the user", dir)
+	}
+	return nil
+}
+
+// randomName returns a name made of prefix and a random suffix.
+func randomName(prefix string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// GetKRB5CCNAME generates a random filename in the user credentials directory
+// dir to store Kerberos credentials.
+func GetKRB5CCNAME(userInfo *user.User, dir string) (string, error) {
+	name, err := randomName(fmt.Sprintf("krb5cc_%s_", userInfo.Uid))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// copyCredFile copies the credentials file src, written by root, to a new file
+// dst owned by the user with mode 0600. The file is created exclusively and
+// symbolic links are never followed.
+func copyCredFile(userInfo *user.User, src, dst string) error {
+	in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !fi.Mode().IsRegular() || !ok || st.Uid != 0 {
+		return fmt.Errorf("%s is not a regular file owned by root", src)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+
+	uid, _ := strconv.Atoi(userInfo.Uid)
+	gid, _ := strconv.Atoi(userInfo.Gid)
+	err = out.Chown(uid, gid)
+	if err == nil {
+		err = out.Chmod(0600)
+	}
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// writeCredFile creates a new credentials file of the user in dir, which must
+// be a directory returned by userCredDir. The credentials are written by the
+// store function in a file only readable by root, then copied to a file owned
+// by the user which appears atomically under its final name. It returns the
+// name of the file or an error if any, in which case no file is left.
+func writeCredFile(userInfo *user.User, dir string, store func(krb5ccname string) error) (string, error) {
+	if err := checkCredDir(dir); err != nil {
+		return "", err
+	}
+
+	krb5ccname, err := GetKRB5CCNAME(userInfo, dir)
+	if err != nil {
+		return "", err
+	}
+	staging, err := randomName(filepath.Join(dir, ".staging_"))
+	if err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, "."+filepath.Base(krb5ccname))
+
+	defer os.Remove(staging)
+	if err := store(staging); err != nil {
+		return "", err
+	}
+
+	if err := copyCredFile(userInfo, staging, tmp); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp, krb5ccname); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return krb5ccname, nil
+}
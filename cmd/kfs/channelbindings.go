@@ -0,0 +1,124 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <gssapi/gssapi.h>
+
+// kfs_channel_bindings returns newly allocated channel bindings whose
+// application data is a copy of the provided data.
+static gss_channel_bindings_t
+kfs_channel_bindings(const void *data, size_t len)
+{
+	gss_channel_bindings_t cb = calloc(1, sizeof(*cb));
+	if (cb == NULL)
+		return NULL;
+
+	cb->application_data.value = malloc(len);
+	if (cb->application_data.value == NULL) {
+		free(cb);
+		return NULL;
+	}
+	memcpy(cb->application_data.value, data, len);
+	cb->application_data.length = len;
+
+	return cb;
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	_ "crypto/sha256" // register hash functions used by certificates
+	_ "crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/cea-hpc/gssapi"
+)
+
+// Channel bindings policies.
+const (
+	channelBindingsOff      = "off"      // no channel bindings
+	channelBindingsOptional = "optional" // checked if the client provides them
+	channelBindingsRequired = "required" // clients must provide them
+)
+
+// GSS_C_CHANNEL_BOUND_FLAG is set in the flags of a context established
+// with matching channel bindings.
+const gssChannelBoundFlag = 2048
+
+// checkChannelBindingsPolicy returns an error if the policy is invalid.
+func checkChannelBindingsPolicy(policy string) error {
+	switch policy {
+	case channelBindingsOff, channelBindingsOptional, channelBindingsRequired:
+		return nil
+	}
+	return fmt.Errorf("invalid channel bindings policy: %s", policy)
+}
+
+// certificateHash returns the hash function used for the tls-server-end-point
+// channel bindings of the certificate (RFC 5929 section 4.1).
+func certificateHash(cert *x509.Certificate) (crypto.Hash, error) {
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.DSAWithSHA256, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		return crypto.SHA256, nil
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		return crypto.SHA384, nil
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("no channel bindings hash for signature algorithm %s", cert.SignatureAlgorithm)
+}
+
+// TLSServerEndPoint returns the tls-server-end-point channel bindings data of
+// the certificate found in the provided file.
+func TLSServerEndPoint(certFile, keyFile string) ([]byte, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := certificateHash(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(cert.Raw)
+
+	return append([]byte("tls-server-end-point:"), h.Sum(nil)...), nil
+}
+
+// NewChannelBindings returns GSSAPI channel bindings with the provided
+// application data. They are never freed and must be created once.
+func NewChannelBindings(data []byte) (gssapi.ChannelBindings, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty channel bindings")
+	}
+
+	cb := C.kfs_channel_bindings(unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	if cb == nil {
+		return nil, errors.New("cannot allocate channel bindings")
+	}
+
+	return gssapi.ChannelBindings(unsafe.Pointer(cb)), nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cea-hpc/gssapi"
+)
+
+// Constrained delegation modes.
+const (
+	delegationOff      = "off"      // never used
+	delegationFallback = "fallback" // used when the user has no delegated credentials
+	delegationAlways   = "always"   // always used, delegated credentials are ignored
+)
+
+// delegationConfig defines how user credentials are obtained with
+// constrained delegation (S4U2Self and S4U2Proxy).
+type delegationConfig struct {
+	Mode      string   // off, fallback or always
+	Principal string   // impersonator principal (default: service name)
+	Keytab    string   // keytab of the impersonator (default: keytab)
+	Targets   []string // storage service principals (e.g. nfs/server.example.com)
+}
+
+// init sets default values and checks the configuration.
+func (c *delegationConfig) init(keytab, serviceName string) error {
+	switch c.Mode {
+	case "":
+		c.Mode = delegationOff
+	case delegationOff, delegationFallback, delegationAlways:
+	default:
+		return fmt.Errorf("invalid constrained delegation mode: %s", c.Mode)
+	}
+
+	if c.Mode == delegationOff {
+		return nil
+	}
+
+	if c.Principal == "" {
+		c.Principal = serviceName
+	}
+
+	if c.Keytab == "" {
+		c.Keytab = keytab
+	}
+
+	if len(c.Targets) == 0 {
+		return errors.New("no target service principal defined for constrained delegation")
+	}
+
+	return nil
+}
+
+// enabled returns true if constrained delegation may be used.
+func (c *delegationConfig) enabled() bool {
+	return c.Mode != delegationOff
+}
+
+// use returns true if constrained delegation must be used for a user who
+// delegated the provided credentials.
+func (c *delegationConfig) use(delegatedCred *gssapi.CredId) bool {
+	switch c.Mode {
+	case delegationAlways:
+		return true
+	case delegationFallback:
+		return delegatedCred.IsEmpty()
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+/*
+#cgo linux LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+#include <gssapi/gssapi.h>
+#include <gssapi/gssapi_ext.h>
+
+// GSSAPI extensions not provided by the gssapi package. They are resolved with
+// dlsym() in the same library.
+static OM_uint32 (*fp_gss_acquire_cred_from)(OM_uint32 *, gss_const_name_t, OM_uint32,
+	const gss_OID_set, gss_cred_usage_t, gss_const_key_value_set_t, gss_cred_id_t *,
+	gss_OID_set *, OM_uint32 *);
+
+static char *
+kfs_gss_load(const char *path)
+{
+	void *h = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (h == NULL)
+		return strdup(dlerror());
+
+	*(void **)&fp_gss_acquire_cred_from = dlsym(h, "gss_acquire_cred_from");
+	if (fp_gss_acquire_cred_from == NULL)
+		return strdup(dlerror());
+
+	return NULL;
+}
+
+// kfs_gss_acquire_cred_from acquires acceptor credentials for the name (or
+// any principal if it is GSS_C_NO_NAME) from the keytab.
+static OM_uint32
+kfs_gss_acquire_cred_from(OM_uint32 *minor, void *name, const char *keytab, void **cred)
+{
+	gss_key_value_element_desc element = { "keytab", keytab };
+	gss_key_value_set_desc store = { 1, &element };
+
+	return fp_gss_acquire_cred_from(minor, (gss_name_t)name, GSS_C_INDEFINITE,
+		GSS_C_NO_OID_SET, GSS_C_ACCEPT, &store, (gss_cred_id_t *)cred, NULL, NULL);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/cea-hpc/gssapi"
+)
+
+// LoadGSSExtensions loads the GSSAPI extensions from the gssapi library.
+func LoadGSSExtensions(gssapiLib string) error {
+	path := (&gssapi.Options{LibPath: gssapiLib}).Path()
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	return cError(C.kfs_gss_load(cPath))
+}
+
+// gssError returns the error matching GSSAPI status codes or nil.
+func gssError(lib *gssapi.Lib, major, minor C.OM_uint32) error {
+	e := &gssapi.Error{Lib: lib, Major: gssapi.MajorStatus(major)}
+	*(*C.OM_uint32)(unsafe.Pointer(&e.Minor)) = minor
+	return e.GoError()
+}
+
+// AcquireCredFrom acquires acceptor credentials for the principal from the
+// keytab. If principal is empty, the credentials accept any principal of the
+// keytab. The credentials must be released by the caller.
+func AcquireCredFrom(lib *gssapi.Lib, principal, keytab string) (*gssapi.CredId, error) {
+	var cName unsafe.Pointer
+	if principal != "" {
+		nameBuf, err := lib.MakeBufferString(principal)
+		if err != nil {
+			return nil, err
+		}
+		defer nameBuf.Release()
+
+		name, err := nameBuf.Name(lib.GSS_KRB5_NT_PRINCIPAL_NAME)
+		if err != nil {
+			return nil, err
+		}
+		defer name.Release()
+		cName = *(*unsafe.Pointer)(unsafe.Pointer(&name.C_gss_name_t))
+	}
+
+	cKeytab := C.CString(keytab)
+	defer C.free(unsafe.Pointer(cKeytab))
+
+	var minor C.OM_uint32
+	var cCred unsafe.Pointer
+	major := C.kfs_gss_acquire_cred_from(&minor, cName, cKeytab, &cCred)
+	if err := gssError(lib, major, minor); err != nil {
+		return nil, err
+	}
+
+	cred := lib.NewCredId()
+	*(*unsafe.Pointer)(unsafe.Pointer(&cred.C_gss_cred_id_t)) = cCred
+
+	return cred, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// When hooks are run.
+const (
+	hookBefore = "before" // before the user file server starts
+	hookAfter  = "after"  // after the user file server has started
+)
+
+var defaultHookTimeout = 30 * time.Second
+
+// hookConfig defines a command run as the user when the user file server
+// starts.
+type hookConfig struct {
+	Name     string        // name used in logs (default: base name of the command)
+	Command  []string      // command and arguments
+	When     string        // before or after the user file server starts (default: before)
+	Timeout  time.Duration // maximum duration of the command (default: 30s)
+	Required bool          // if true, a failure aborts the login
+}
+
+// hookError is returned when a required hook fails.
+type hookError struct {
+	name string
+	err  error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("required hook %s failed: %v", e.name, e.err)
+}
+
+// initHooks sets default values of the hooks and checks them.
+func initHooks(hooks []hookConfig) error {
+	for i := range hooks {
+		h := &hooks[i]
+		if len(h.Command) == 0 || h.Command[0] == "" {
+			return fmt.Errorf("hook %d has no command", i+1)
+		}
+		if !filepath.IsAbs(h.Command[0]) {
+			return fmt.Errorf("hook command %s is not an absolute path", h.Command[0])
+		}
+		if h.Name == "" {
+			h.Name = filepath.Base(h.Command[0])
+		}
+		switch h.When {
+		case "":
+			h.When = hookBefore
+		case hookBefore, hookAfter:
+		default:
+			return fmt.Errorf("invalid when of hook %s: %s", h.Name, h.When)
+		}
+		if h.Timeout == 0 {
+			h.Timeout = defaultHookTimeout
+		}
+		if h.Timeout < 0 {
+			return fmt.Errorf("timeout of hook %s must be positive", h.Name)
+		}
+	}
+	return nil
+}
+
+// run runs the hook as the user with the provided credential cache. The output
+// of the command is logged.
+func (h *hookConfig) run(userInfo *user.User, krb5ccname string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Dir = "/"
+	cmd.Env = []string{
+		"KRB5CCNAME=" + krb5ccname,
+		"HOME=" + userInfo.HomeDir,
+		"USER=" + userInfo.Username,
+		"LOGNAME=" + userInfo.Username,
+		"PATH=/usr/bin:/bin",
+	}
+	cmd.SysProcAttr = userSysProcAttr(userInfo)
+
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	in := bufio.NewScanner(bytes.NewReader(out))
+	for in.Scan() {
+		log.Printf("[%s] hook %s: %s", userInfo.Username, h.Name, in.Text())
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", h.Timeout)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] INFO: hook %s succeeded in %v", userInfo.Username, h.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runHooks runs in order the hooks matching when. Failures are logged and a
+// *hookError is returned on the first failure of a required hook.
+func runHooks(hooks []hookConfig, when string, userInfo *user.User, krb5ccname string) error {
+	for i := range hooks {
+		h := &hooks[i]
+		if h.When != when {
+			continue
+		}
+		if err := h.run(userInfo, krb5ccname); err != nil {
+			log.Printf("[%s] ERROR: hook %s failed: %v", userInfo.Username, h.Name, err)
+			if h.Required {
+				return &hookError{name: h.Name, err: err}
+			}
+		}
+	}
+	return nil
+}
@@ -11,11 +11,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
-	"os"
+	"net/http"
 	"os/user"
-	"strconv"
 	"strings"
 	"time"
 
@@ -30,8 +29,9 @@ func (key contextKey) String() string {
 }
 
 const (
-	serverKey     = contextKey("server")
-	credentialKey = contextKey("credential")
+	serverKey          = contextKey("server")
+	credentialKey      = contextKey("credential")
+	channelBindingsKey = contextKey("channelBindings")
 )
 
 // Server returns the spnego.KerberizedServer instance stored in context.
@@ -39,15 +39,35 @@ func Server(ctx context.Context) spnego.KerberizedServer {
 	return ctx.Value(serverKey).(spnego.KerberizedServer)
 }
 
-// Credential returns the Kerberos server credentials stored in context.
-func Credential(ctx context.Context) *gssapi.CredId {
-	return ctx.Value(credentialKey).(*gssapi.CredId)
+// Credentials returns the current Kerberos server credentials stored in
+// context.
+func Credentials(ctx context.Context) *serverCredentials {
+	return getCredentialsHolder(ctx).get()
+}
+
+// getCredentialsHolder returns the holder of the Kerberos server credentials
+// stored in context.
+func getCredentialsHolder(ctx context.Context) *credentialsHolder {
+	return ctx.Value(credentialKey).(*credentialsHolder)
+}
+
+// ChannelBindings returns the channel bindings stored in context.
+func ChannelBindings(ctx context.Context) gssapi.ChannelBindings {
+	cb, _ := ctx.Value(channelBindingsKey).(gssapi.ChannelBindings)
+	return cb
+}
+
+// WithChannelBindings adds to the provided context the channel bindings used
+// to accept security contexts.
+func WithChannelBindings(ctx context.Context, cb gssapi.ChannelBindings) context.Context {
+	return context.WithValue(ctx, channelBindingsKey, cb)
 }
 
 // WithContext adds to the provided context all needed Kerberos parameters: a
-// spnego.KerberizedServer instance and the server Kerberos credentials.
+// spnego.KerberizedServer instance and the server Kerberos credentials of the
+// service principals (or of any principal of the keytab if acceptAny is true).
 // It returns the new context or an error if any.
-func WithContext(ctx context.Context, keytab, spn, gssapiLib string) (context.Context, error) {
+func WithContext(ctx context.Context, keytab string, services []servicePrincipal, acceptAny bool, gssapiLib string) (context.Context, error) {
 	gss, err := gssapi.Load(&gssapi.Options{
 		LibPath:    gssapiLib,
 		Krb5Ktname: keytab,
@@ -59,53 +79,117 @@ func WithContext(ctx context.Context, keytab, spn, gssapiLib string) (context.Co
 	server := spnego.KerberizedServer{Lib: gss}
 	ctx = context.WithValue(ctx, serverKey, server)
 
-	cred, err := server.AcquireCred(spn)
+	for _, s := range services {
+		if s.Keytab != keytab && !acceptAny {
+			if err := LoadGSSExtensions(gssapiLib); err != nil {
+				return ctx, fmt.Errorf("loading GSSAPI extensions: %v", err)
+			}
+			break
+		}
+	}
+
+	creds, err := acquireServerCredentials(server, keytab, services, acceptAny)
 	if err != nil {
 		return ctx, err
 	}
 
-	return context.WithValue(ctx, credentialKey, cred), nil
-}
+	holder := &credentialsHolder{
+		server:    server,
+		keytab:    keytab,
+		services:  services,
+		acceptAny: acceptAny,
+	}
+	holder.current.Store(creds)
 
-// GetUser returns the user infos deduced from the provided Kerberos username
-// (ie. login@REALM) or an error if any.
-func GetUser(krbusername string) (*user.User, error) {
-	username := strings.SplitN(krbusername, "@", 2)[0]
-	return user.Lookup(username)
+	return context.WithValue(ctx, credentialKey, holder), nil
 }
 
-var allowedChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+// Negotiate handles the SPNEGO client-server negotiation like
+// spnego.KerberizedServer.Negotiate but accepts the security context with the
+// provided channel bindings. It also returns the flags of the context.
+func Negotiate(server spnego.KerberizedServer, cred *gssapi.CredId, cb gssapi.ChannelBindings, inHeader, outHeader http.Header) (string, int, *gssapi.CredId, uint32, error) {
+	negotiate, inputToken := spnego.CheckSPNEGONegotiate(server.Lib, inHeader, "Authorization")
+	defer inputToken.Release()
 
-// GetKRB5CCNAME generates a pseudo-random filename in /tmp to store Kerberos
-// credentials.
-func GetKRB5CCNAME(userInfo *user.User) string {
-	krb5ccname := fmt.Sprintf("/tmp/krb5cc_%s_", userInfo.Uid)
-	nchars := int32(len(allowedChars))
-	for i := 0; i < 10; i++ {
-		krb5ccname += string(allowedChars[rand.Int31n(nchars)])
+	if !negotiate || inputToken.Length() == 0 {
+		spnego.AddSPNEGONegotiate(outHeader, "WWW-Authenticate", inputToken)
+		return "", http.StatusUnauthorized, nil, 0, errors.New("SPNEGO: unauthorized")
+	}
+
+	if cb == nil {
+		cb = server.GSS_C_NO_CHANNEL_BINDINGS
+	}
+
+	ctx, srcName, _, outputToken, flags, _, delegatedCredHandle, err :=
+		server.AcceptSecContext(server.GSS_C_NO_CONTEXT, cred, inputToken, cb)
+	if err != nil {
+		return "", http.StatusBadRequest, nil, 0, err
 	}
-	return krb5ccname
+	ctx.DeleteSecContext()
+	outputToken.Release()
+	defer srcName.Release()
+
+	return srcName.String(), http.StatusOK, delegatedCredHandle, flags, nil
 }
 
-// SaveCred saves Kerberos credentials in a file. It returns the name of the
-// file or an error if any.
-func SaveCred(userInfo *user.User, cred *gssapi.CredId) (string, error) {
-	krb5ccname := GetKRB5CCNAME(userInfo)
-	if err := cred.Store(krb5ccname); err != nil {
-		return "", err
+var defaultRenewMargin = 10 * time.Minute
+
+// renewalConfig defines the automatic renewal of user tickets.
+type renewalConfig struct {
+	Enabled bool          // renew renewable user TGTs
+	Margin  time.Duration // renew tickets this long before expiry
+}
+
+// init sets default values and checks the configuration.
+func (c *renewalConfig) init() error {
+	if c.Margin == 0 {
+		c.Margin = defaultRenewMargin
+	}
+	if c.Margin < 0 {
+		return errors.New("ticket renewal margin cannot be a negative number")
 	}
+	return nil
+}
 
-	uid, _ := strconv.Atoi(userInfo.Uid)
-	gid, _ := strconv.Atoi(userInfo.Gid)
-	if err := os.Chown(krb5ccname, uid, gid); err != nil {
-		return "", err
+// margin returns the renewal margin or 0 if renewal is disabled.
+func (c *renewalConfig) margin() time.Duration {
+	if !c.Enabled {
+		return 0
 	}
+	return c.Margin
+}
 
-	if err := os.Chmod(krb5ccname, 0600); err != nil {
-		return "", err
+// GetUser returns the user infos deduced from the provided Kerberos username
+// (ie. login@REALM) or an error if any.
+func GetUser(krbusername string) (*user.User, error) {
+	username := strings.SplitN(krbusername, "@", 2)[0]
+	return user.Lookup(username)
+}
+
+// SaveCred saves Kerberos credentials in a new credential cache of the user.
+// It returns the name of the credential cache or an error if any.
+func SaveCred(userInfo *user.User, ccache *ccacheConfig, cred *gssapi.CredId) (string, error) {
+	return ccache.save(userInfo, func(krb5ccname string) error {
+		return cred.Store(krb5ccname)
+	})
+}
+
+// SaveImpersonatedCred obtains Kerberos credentials for the user with
+// constrained delegation and saves them in a new credential cache of the user.
+// It returns the name of the credential cache and the lifetime of the
+// credentials or an error if any.
+func SaveImpersonatedCred(userInfo *user.User, krbusername string, ccache *ccacheConfig, cfg *delegationConfig) (string, time.Duration, error) {
+	var endtime time.Time
+	krb5ccname, err := ccache.save(userInfo, func(krb5ccname string) error {
+		var err error
+		endtime, err = Impersonate(cfg.Keytab, cfg.Principal, krbusername, cfg.Targets, "FILE:"+krb5ccname)
+		return err
+	})
+	if err != nil {
+		return "", 0, err
 	}
 
-	return krb5ccname, nil
+	return krb5ccname, time.Until(endtime), nil
 }
 
 // GetCredLifetime returns the lifetime of the provided credentials or an error
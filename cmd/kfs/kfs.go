@@ -20,9 +20,11 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cea-hpc/kfs"
@@ -30,30 +32,46 @@ import (
 )
 
 var (
-	defaultListenAddr     = ":8080"
-	defaultKeytab         = "/etc/krb5.keytab"
-	defaultUserFileServer = "kfs-user"
-	defaultWWWRoute       = map[string]string{
-		"/": "{{HOME}}",
+	defaultListenAddr      = ":8080"
+	defaultKeytab          = "/etc/krb5.keytab"
+	defaultUserFileServer  = "kfs-user"
+	defaultMinCredLifetime = 5 * time.Minute
+	defaultWWWRoute        = routesMap{
+		"/": {Path: "{{HOME}}"},
 	}
 )
 
 // record of each user file server
 var userFileServers = make(map[string]*UserFileServer)
 
-type routesMap map[string]string
-
 type serverConfig struct {
-	GssapiLibPath  string        `yaml:"gssapi_lib_path"` // Path to gssapi shared library
-	Listen         string        // Listen address [host]:port
-	Keytab         string        // Path to keytab
-	UserFileServer string        `yaml:"user_file_server"` // Path to user file server
-	ServiceName    string        `yaml:"service_name"`     // Kerberos service name
-	Realms         []string      // Kerberos realms for user authentication
-	TLSCertFile    string        `yaml:"tls_cert_file"` // TLS certicate file
-	TLSKeyFile     string        `yaml:"tls_key_file"`  // TLS key file
-	MaxLifetime    time.Duration `yaml:"max_lifetime"`  // Maximum lifetime of user file server
-	Routes         routesMap     // Web routing definition.
+	GssapiLibPath   string             `yaml:"gssapi_lib_path"` // Path to gssapi shared library
+	Krb5LibPath     string             `yaml:"krb5_lib_path"`   // Path to Kerberos 5 shared library
+	Listen          string             // Listen address [host]:port
+	Keytab          string             // Path to keytab
+	UserFileServer  string             `yaml:"user_file_server"`     // Path to user file server
+	ServiceName     string             `yaml:"service_name"`         // Kerberos service name
+	Services        []servicePrincipal `yaml:"service_principals"`   // Kerberos service principals
+	AcceptAny       bool               `yaml:"accept_any_principal"` // Accept any principal of the keytab
+	Realms          []string           // Kerberos realms for user authentication (deprecated)
+	TrustedRealms   realmPolicy        `yaml:"trusted_realms"` // Kerberos realms trusted for user authentication
+	TLSCertFile     string             `yaml:"tls_cert_file"`  // TLS certicate file
+	TLSKeyFile      string             `yaml:"tls_key_file"`   // TLS key file
+	MaxLifetime     time.Duration      `yaml:"max_lifetime"`   // Maximum lifetime of user file server
+	Routes          routesMap          // Web routing definition.
+	RouteSets       []routeSet         `yaml:"route_sets"` // Group and realm conditional routes
+	Access          accessRules        // Access control rules
+	Throttle        throttleConfig     `yaml:"password_throttle"`      // Password brute-force protection
+	Delegation      delegationConfig   `yaml:"constrained_delegation"` // Constrained delegation (S4U)
+	Tokens          tokenConfig        `yaml:"api_tokens"`             // Personal API tokens
+	ChannelBinding  string             `yaml:"channel_bindings"`       // TLS channel bindings policy
+	Renewal         renewalConfig      `yaml:"ticket_renewal"`         // Renewal of user tickets
+	KeytabCheck     time.Duration      `yaml:"keytab_check_interval"`  // Interval between keytab change checks
+	Ccache          ccacheConfig       // Credential caches of users
+	StateDir        string             `yaml:"state_dir"` // Directory recording credential caches and processes
+	Hooks           []hookConfig       // Commands run as the user when the user file server starts
+	MinCredLifetime time.Duration      `yaml:"min_credential_lifetime"` // Minimum lifetime of user credentials
+	Archive         archiveConfig      // Limits of directory archives
 }
 
 // key used in context to store application configuration
@@ -64,6 +82,27 @@ func getConfig(ctx context.Context) *serverConfig {
 	return ctx.Value(configKey).(*serverConfig)
 }
 
+// key used in context to store password authentication throttle
+var throttleKey = contextKey("throttle")
+
+func getThrottle(ctx context.Context) *throttle {
+	return ctx.Value(throttleKey).(*throttle)
+}
+
+// key used in context to store personal API tokens
+var tokensKey = contextKey("tokens")
+
+func getTokens(ctx context.Context) *tokenStore {
+	return ctx.Value(tokensKey).(*tokenStore)
+}
+
+// key used in context to store the state directory
+var stateKey = contextKey("state")
+
+func getState(ctx context.Context) *stateDir {
+	return ctx.Value(stateKey).(*stateDir)
+}
+
 // Fqdn returns the host FQDN or an error if any.
 func Fqdn() (string, error) {
 	hostname, err := os.Hostname()
@@ -104,7 +143,7 @@ func loadConfig(filename string) (*serverConfig, error) {
 		return nil, err
 	}
 
-	cfg := &serverConfig{}
+	cfg := &serverConfig{MinCredLifetime: defaultMinCredLifetime}
 
 	if err := yaml.Unmarshal(yamlFile, cfg); err != nil {
 		return nil, err
@@ -118,6 +157,22 @@ func loadConfig(filename string) (*serverConfig, error) {
 		cfg.Keytab = defaultKeytab
 	}
 
+	if cfg.ChannelBinding == "" {
+		cfg.ChannelBinding = channelBindingsOff
+	}
+
+	if cfg.StateDir == "" {
+		cfg.StateDir = defaultStateDir
+	}
+
+	if cfg.KeytabCheck == 0 {
+		cfg.KeytabCheck = defaultKeytabCheckInterval
+	}
+
+	if cfg.Krb5LibPath == "" {
+		cfg.Krb5LibPath = defaultKrb5Lib
+	}
+
 	if cfg.UserFileServer == "" {
 		cfg.UserFileServer = defaultUserFileServer
 	}
@@ -126,6 +181,10 @@ func loadConfig(filename string) (*serverConfig, error) {
 		cfg.Routes = defaultWWWRoute
 	}
 
+	if cfg.ServiceName == "" && len(cfg.Services) != 0 {
+		cfg.ServiceName = cfg.Services[0].Name
+	}
+
 	if cfg.ServiceName == "" {
 		hostname, err := Fqdn()
 		if err != nil {
@@ -134,6 +193,14 @@ func loadConfig(filename string) (*serverConfig, error) {
 		cfg.ServiceName = fmt.Sprintf("HTTP/%s", hostname)
 	}
 
+	if len(cfg.Services) == 0 {
+		cfg.Services = []servicePrincipal{{Name: cfg.ServiceName}}
+	}
+
+	if err := initServicePrincipals(cfg.Services, cfg.Keytab); err != nil {
+		return nil, err
+	}
+
 	if cfg.TLSCertFile == "" {
 		return nil, errors.New("no TLS certificate file specified in configuration")
 	}
@@ -146,6 +213,60 @@ func loadConfig(filename string) (*serverConfig, error) {
 		return nil, errors.New("maximum lifetime cannot be a negative number")
 	}
 
+	if err := cfg.Routes.check(); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.RouteSets {
+		if err := cfg.RouteSets[i].check(); err != nil {
+			return nil, fmt.Errorf("route set %d: %v", i+1, err)
+		}
+	}
+
+	if cfg.Access.MinUID < 0 {
+		return nil, errors.New("minimum UID cannot be a negative number")
+	}
+
+	if err := cfg.TrustedRealms.init(cfg.Realms); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Throttle.init(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Delegation.init(cfg.Keytab, cfg.ServiceName); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Tokens.init(); err != nil {
+		return nil, err
+	}
+
+	if err := checkChannelBindingsPolicy(cfg.ChannelBinding); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Archive.init(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Renewal.init(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Ccache.init(cfg.Krb5LibPath); err != nil {
+		return nil, err
+	}
+
+	if err := initHooks(cfg.Hooks); err != nil {
+		return nil, err
+	}
+
+	if cfg.KeytabCheck < 0 {
+		return nil, errors.New("keytab_check_interval must be positive")
+	}
+
 	return cfg, nil
 }
 
@@ -153,100 +274,307 @@ func internalServerError(w http.ResponseWriter) {
 	http.Error(w, "Internal server error: contact your administrator.", http.StatusInternalServerError)
 }
 
+// errCredentialExpiring is the error code returned to clients whose delegated
+// credentials expire too soon.
+const errCredentialExpiring = "credential_expiring"
+
+// credentialExpiring answers that the user credentials expire too soon and
+// must be renewed with kinit. Clients accepting JSON get a JSON error and
+// others a page. The error code is also in the Kfs-Error header for scripts.
+func credentialExpiring(w http.ResponseWriter, r *http.Request, lifetime, minLifetime time.Duration) {
+	msg := fmt.Sprintf("Your Kerberos credentials expire in %v, less than the required %v. Run kinit to get new credentials and try again.",
+		lifetime.Round(time.Second), minLifetime)
+
+	w.Header().Set("Kfs-Error", errCredentialExpiring)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusForbidden, map[string]string{
+			"error":   errCredentialExpiring,
+			"message": msg,
+		})
+		return
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
+
+func hookFailed(w http.ResponseWriter, err error) {
+	name := ""
+	if e, ok := err.(*hookError); ok {
+		name = e.name
+	}
+	http.Error(w, fmt.Sprintf("Login failed: setup step %q did not succeed. Contact your administrator.", name), http.StatusInternalServerError)
+}
+
+func forbidden(w http.ResponseWriter) {
+	http.Error(w, "Forbidden.", http.StatusForbidden)
+}
+
+// isCrossSite returns true if the request may modify files and was sent by a
+// browser from a page of another site. Browsers send credentials of Negotiate
+// and Basic authentication with such requests: they are rejected so that other
+// sites cannot modify the files of the user (cross-site request forgery).
+func isCrossSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err != nil || u.Host != r.Host
+	}
+	return false
+}
+
+// tokenHandler serves a request authenticated with a personal API token.
+func tokenHandler(w http.ResponseWriter, r *http.Request, tokens *tokenStore, value string) {
+	if tokens == nil {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	t, err := tokens.lookup(value)
+	if err != nil {
+		log.Printf("ERROR: rejecting token from %s: %v", r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	if isTokensPath(r.URL.Path) || !t.allows(r) {
+		log.Printf("[%s] ERROR: token %s does not allow %s %s", t.krbusername, t.ID, r.Method, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		forbidden(w)
+		return
+	}
+
+	proxy(w, r, t.fs, t.krbusername, t.Routes)
+}
+
 func connectHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	server := Server(ctx)
-	cred := Credential(ctx)
+	cred := Credentials(ctx).forRequest(r).cred
 	cfg := getConfig(ctx)
 
-	krbusername, status, delegatedCred, err := server.Negotiate(cred, r.Header, w.Header())
+	if value, ok := bearerToken(r); ok {
+		tokenHandler(w, r, getTokens(ctx), value)
+		return
+	}
+
+	// Tokens are not sent by browsers on their own: only requests
+	// authenticated otherwise can be forged.
+	if isCrossSite(r) {
+		log.Printf("ERROR: rejecting cross-site %s %s from %s (origin %q)", r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("Origin"))
+		forbidden(w)
+		return
+	}
+
+	krbusername, status, delegatedCred, flags, err := Negotiate(server, cred, ChannelBindings(ctx), r.Header, w.Header())
 
-outerswitch:
 	switch {
+	case status == http.StatusUnauthorized && cfg.ChannelBinding == channelBindingsRequired:
+		// Password logins cannot provide channel bindings.
+		if _, _, ok := r.BasicAuth(); ok {
+			log.Printf("ERROR: rejecting password login: channel bindings required")
+		}
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		http.Error(w, "Unauthorized: channel bindings required.", http.StatusUnauthorized)
+		return
 	case status == http.StatusUnauthorized:
-		username, pass, ok := r.BasicAuth()
-
+		var ok bool
+		krbusername, delegatedCred, ok = basicLogin(w, r, server, getThrottle(ctx), &cfg.TrustedRealms)
 		if !ok {
-			w.Header().Set("WWW-Authenticate", "Negotiate")
-			w.Header().Add("WWW-Authenticate", `Basic realm="Please enter your username and password."`)
-			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 			return
 		}
-
-		usernames := []string{}
-		if !strings.Contains(username, "@") && len(cfg.Realms) != 0 {
-			for _, realm := range cfg.Realms {
-				usernames = append(usernames, fmt.Sprintf("%s@%s", username, realm))
-			}
-		} else {
-			usernames = append(usernames, username)
-		}
-
-		for _, krbusername = range usernames {
-			delegatedCred, err = server.AuthenticateUserWithPassword(krbusername, pass)
-			if err == nil {
-				break outerswitch
-			}
-		}
-		log.Printf("ERROR: cannot authenticate user `%s` with password", username)
-		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
-		return
 	case status != http.StatusOK:
 		log.Printf("ERROR: SPNEGO negotiate: %v", err)
 		internalServerError(w)
 		return
 	}
 
-	userInfo, err := GetUser(krbusername)
-	if err != nil {
-		log.Printf("ERROR: GetUser(%s): %v", krbusername, err)
-		internalServerError(w)
+	if cfg.ChannelBinding == channelBindingsRequired && flags&gssChannelBoundFlag == 0 {
+		log.Printf("ERROR: rejecting login of %s: no channel bindings provided", krbusername)
+		delegatedCred.Release()
+		http.Error(w, "Unauthorized: channel bindings required.", http.StatusUnauthorized)
 		return
 	}
 
-	if delegatedCred.IsEmpty() {
-		log.Printf("ERROR: user %s didn't delegate us their credentials", krbusername)
-		internalServerError(w)
+	if err := cfg.TrustedRealms.check(krbusername); err != nil {
+		log.Printf("ERROR: rejecting login: %v", err)
+		delegatedCred.Release()
+		forbidden(w)
 		return
 	}
 
-	credLifetime, err := GetCredLifetime(delegatedCred)
+	userInfo, err := GetUser(krbusername)
 	if err != nil {
-		log.Printf("ERROR: querying lifetime of user %s credential: %v", userInfo.Username, err)
+		log.Printf("ERROR: GetUser(%s): %v", krbusername, err)
+		delegatedCred.Release()
 		internalServerError(w)
 		return
 	}
 
-	krb5ccname, err := SaveCred(userInfo, delegatedCred)
-	delegatedCred.Release()
-	if err != nil {
-		log.Printf("ERROR: saving user %s credential: %v", userInfo.Username, err)
-		internalServerError(w)
+	if err := cfg.Access.check(krbusername, userInfo); err != nil {
+		auditAccessDenied(krbusername, r.RemoteAddr, err)
+		delegatedCred.Release()
+		http.Error(w, "Forbidden: access denied by the server policy.", http.StatusForbidden)
 		return
 	}
 
+	var krb5ccname string
+	var credLifetime time.Duration
+
+	impersonated := cfg.Delegation.use(delegatedCred)
+	if impersonated {
+		delegatedCred.Release()
+		krb5ccname, credLifetime, err = SaveImpersonatedCred(userInfo, krbusername, &cfg.Ccache, &cfg.Delegation)
+		if err != nil {
+			log.Printf("ERROR: getting user %s credential with constrained delegation: %v", userInfo.Username, err)
+			internalServerError(w)
+			return
+		}
+	} else {
+		if delegatedCred.IsEmpty() {
+			log.Printf("ERROR: user %s didn't delegate us their credentials", krbusername)
+			internalServerError(w)
+			return
+		}
+
+		credLifetime, err = GetCredLifetime(delegatedCred)
+		if err != nil {
+			log.Printf("ERROR: querying lifetime of user %s credential: %v", userInfo.Username, err)
+			delegatedCred.Release()
+			internalServerError(w)
+			return
+		}
+
+		// Renewable credentials are renewed by the user file server
+		// before they expire: they are checked once saved.
+		expiring := cfg.MinCredLifetime > 0 && credLifetime < cfg.MinCredLifetime
+		if expiring && !cfg.Renewal.Enabled {
+			log.Printf("[%s] ERROR: credential expires in %v, less than %v", krbusername, credLifetime, cfg.MinCredLifetime)
+			delegatedCred.Release()
+			credentialExpiring(w, r, credLifetime, cfg.MinCredLifetime)
+			return
+		}
+
+		krb5ccname, err = SaveCred(userInfo, &cfg.Ccache, delegatedCred)
+		delegatedCred.Release()
+		if err != nil {
+			log.Printf("ERROR: saving user %s credential: %v", userInfo.Username, err)
+			internalServerError(w)
+			return
+		}
+
+		if expiring {
+			if _, renewTill, err := cfg.Ccache.times(userInfo, krb5ccname); err != nil || time.Until(renewTill) < cfg.MinCredLifetime {
+				log.Printf("[%s] ERROR: credential expires in %v, less than %v, and cannot be renewed", krbusername, credLifetime, cfg.MinCredLifetime)
+				if err := cfg.Ccache.remove(userInfo, krb5ccname); err != nil {
+					log.Printf("[%s] ERROR: cannot remove %s: %v", krbusername, krb5ccname, err)
+				}
+				credentialExpiring(w, r, credLifetime, cfg.MinCredLifetime)
+				return
+			}
+		}
+	}
+
 	fs, ok := userFileServers[userInfo.Username]
 	if !ok {
-		fs = NewUserFileServer(userInfo, cfg.UserFileServer, cfg.MaxLifetime, cfg.Routes)
+		fs = NewUserFileServer(userInfo, cfg.UserFileServer, cfg.MaxLifetime, cfg.Routes, cfg.RouteSets, cfg.Renewal.margin(), &cfg.Ccache, getState(ctx), &cfg.Archive)
 		userFileServers[userInfo.Username] = fs
 	}
 
-	if fs.Alive {
-		fs.NewCredentials(krb5ccname, credLifetime)
+	// Routes depend on the realm: a server started from a principal of
+	// another realm mapped to the same user is not reused.
+	realm := principalRealm(krbusername)
+	alive, _, _ := fs.running()
+	if alive && fs.Realm() != realm {
+		log.Printf("[%s] ERROR: user file server of %s is running for realm %s", krbusername, userInfo.Username, fs.Realm())
+		if err := cfg.Ccache.remove(userInfo, krb5ccname); err != nil {
+			log.Printf("[%s] ERROR: cannot remove %s: %v", krbusername, krb5ccname, err)
+		}
+		http.Error(w, "Conflict: your files are already served to a principal of another realm. Try again once its session ends.", http.StatusConflict)
+		return
+	}
+
+	if alive {
+		fs.NewCredentials(krb5ccname, credLifetime, impersonated)
 	} else {
-		if err := fs.Start(krb5ccname, credLifetime); err != nil {
+		if err := runHooks(cfg.Hooks, hookBefore, userInfo, krb5ccname); err != nil {
+			log.Printf("[%s] ERROR: %v", krbusername, err)
+			if err := cfg.Ccache.remove(userInfo, krb5ccname); err != nil {
+				log.Printf("[%s] ERROR: cannot remove %s: %v", krbusername, krb5ccname, err)
+			}
+			hookFailed(w, err)
+			return
+		}
+		if err := fs.Start(realm, krb5ccname, credLifetime, impersonated); err != nil {
 			log.Printf("[%s] ERROR: starting user file server: %v", krbusername, err)
 			internalServerError(w)
 			return
 		}
+		if err := runHooks(cfg.Hooks, hookAfter, userInfo, krb5ccname); err != nil {
+			log.Printf("[%s] ERROR: %v", krbusername, err)
+			fs.Shutdown()
+			hookFailed(w, err)
+			return
+		}
+	}
+
+	if tokens := getTokens(ctx); tokens != nil && isTokensPath(r.URL.Path) {
+		tokensHandler(w, r, tokens, krbusername, fs)
+		return
 	}
 
+	proxy(w, r, fs, krbusername, nil)
+}
+
+// Request headers forwarded to the user file servers.
+var proxiedHeaders = []string{
+	"Accept", "Content-Type", "If-None-Match", "Want-Repr-Digest",
+	// WebDAV
+	"Depth", "Destination", "Overwrite", "If", "Lock-Token", "Timeout",
+}
+
+// proxyClient is the HTTP client of the user file servers. Redirections are
+// returned to the clients.
+var proxyClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// proxy forwards the request to the user file server. If routes is not empty,
+// the request can only access these routes (see apiToken): the destinations of
+// moves and copies are checked by the user file server.
+func proxy(w http.ResponseWriter, r *http.Request, fs *UserFileServer, krbusername string, routes []string) {
 	log.Printf("[%s] %s %s %s %s\n", krbusername, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
 
-	resp, err := http.Get(fmt.Sprintf("http://%s/%s", fs.Listen, r.URL.Path))
+	u := url.URL{Scheme: "http", Host: fs.Listen, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	req, err := http.NewRequest(r.Method, u.String(), r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), resp.StatusCode)
+		log.Printf("[%s] ERROR: creating proxy request: %v", krbusername, err)
+		internalServerError(w)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	for _, hname := range proxiedHeaders {
+		for _, v := range r.Header[hname] {
+			req.Header.Add(hname, v)
+		}
+	}
+	req.Header.Set(kfs.SecretHeader, fs.Secret())
+	if len(routes) != 0 {
+		req.Header.Set(kfs.TokenRoutesHeader, strings.Join(routes, ","))
+	}
+
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		log.Printf("[%s] ERROR: proxying request: %v", krbusername, err)
+		http.Error(w, "Bad gateway.", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
@@ -267,12 +595,22 @@ outerswitch:
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "usage: kfs [OPTIONS] /path/to/config")
+	fmt.Fprintln(os.Stderr, "       kfs cleanup /path/to/config")
 	fmt.Fprintln(os.Stderr, "\noptions:")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ccache":
+			os.Exit(ccacheCommand(os.Args[2:]))
+		case "cleanup":
+			os.Exit(cleanupCommand(os.Args[2:]))
+		}
+	}
+
 	flag.Usage = usage
 	versionFlag := flag.Bool("version", false, "show version and exit")
 	flag.Parse()
@@ -295,6 +633,20 @@ func main() {
 
 	// save configuration in main context
 	ctx := context.WithValue(context.Background(), configKey, cfg)
+	ctx = context.WithValue(ctx, throttleKey, newThrottle(&cfg.Throttle))
+	ctx = context.WithValue(ctx, tokensKey, newTokenStore(&cfg.Tokens))
+
+	// Clean up what a previous run left behind and record what this one
+	// creates.
+	state, err := openStateDir(cfg.StateDir)
+	if err != nil {
+		log.Fatalf("ERROR: opening state directory: %v", err)
+	}
+	defer state.Close()
+	if n := state.cleanup(&cfg.Ccache); n > 0 {
+		log.Printf("ERROR: cleanup of previous run finished with %d errors", n)
+	}
+	ctx = context.WithValue(ctx, stateKey, state)
 
 	srv := &http.Server{
 		Addr: cfg.Listen,
@@ -330,11 +682,38 @@ func main() {
 		}
 	}()
 
-	ctx, err = WithContext(ctx, cfg.Keytab, cfg.ServiceName, cfg.GssapiLibPath)
+	if cfg.TrustedRealms.acceptsAny() {
+		log.Printf("WARNING: no trusted realm configured, principals of any realm are accepted")
+	}
+
+	if cfg.Delegation.enabled() || cfg.Renewal.Enabled {
+		if err := LoadKrb5(cfg.Krb5LibPath); err != nil {
+			log.Fatalf("ERROR: loading Kerberos 5 library: %v", err)
+		}
+	}
+
+	if cfg.ChannelBinding != channelBindingsOff {
+		data, err := TLSServerEndPoint(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("ERROR: computing channel bindings: %v", err)
+		}
+		cb, err := NewChannelBindings(data)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		ctx = WithChannelBindings(ctx, cb)
+	}
+
+	ctx, err = WithContext(ctx, cfg.Keytab, cfg.Services, cfg.AcceptAny, cfg.GssapiLibPath)
 	if err != nil {
 		log.Fatalf("WithContext(): %s", err)
 	}
 
+	// Re-acquire server credentials when keytabs change or on SIGHUP.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go getCredentialsHolder(ctx).watch(cfg.KeytabCheck, sighup)
+
 	h := http.HandlerFunc(connectHandler)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		h.ServeHTTP(w, r.WithContext(ctx))
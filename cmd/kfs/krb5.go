@@ -0,0 +1,641 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+/*
+#cgo linux LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <krb5.h>
+
+// Functions of the Kerberos 5 library used by kfs. They are resolved with
+// dlsym() like the gssapi library functions.
+static struct {
+	krb5_error_code (*krb5_init_context)(krb5_context *);
+	void (*krb5_free_context)(krb5_context);
+	const char *(*krb5_get_error_message)(krb5_context, krb5_error_code);
+	void (*krb5_free_error_message)(krb5_context, const char *);
+	krb5_error_code (*krb5_parse_name)(krb5_context, const char *, krb5_principal *);
+	void (*krb5_free_principal)(krb5_context, krb5_principal);
+	krb5_error_code (*krb5_kt_resolve)(krb5_context, const char *, krb5_keytab *);
+	krb5_error_code (*krb5_kt_close)(krb5_context, krb5_keytab);
+	krb5_error_code (*krb5_get_init_creds_opt_alloc)(krb5_context, krb5_get_init_creds_opt **);
+	void (*krb5_get_init_creds_opt_free)(krb5_context, krb5_get_init_creds_opt *);
+	void (*krb5_get_init_creds_opt_set_forwardable)(krb5_get_init_creds_opt *, int);
+	krb5_error_code (*krb5_get_init_creds_keytab)(krb5_context, krb5_creds *, krb5_principal,
+		krb5_keytab, krb5_deltat, const char *, krb5_get_init_creds_opt *);
+	krb5_error_code (*krb5_cc_new_unique)(krb5_context, const char *, const char *, krb5_ccache *);
+	krb5_error_code (*krb5_cc_resolve)(krb5_context, const char *, krb5_ccache *);
+	krb5_error_code (*krb5_cc_initialize)(krb5_context, krb5_ccache, krb5_principal);
+	krb5_error_code (*krb5_cc_store_cred)(krb5_context, krb5_ccache, krb5_creds *);
+	krb5_error_code (*krb5_cc_close)(krb5_context, krb5_ccache);
+	krb5_error_code (*krb5_cc_destroy)(krb5_context, krb5_ccache);
+	krb5_error_code (*krb5_get_credentials_for_user)(krb5_context, krb5_flags, krb5_ccache,
+		krb5_creds *, krb5_data *, krb5_creds **);
+	krb5_error_code (*krb5_get_credentials_for_proxy)(krb5_context, krb5_flags, krb5_ccache,
+		krb5_creds *, krb5_ticket *, krb5_creds **);
+	krb5_error_code (*krb5_decode_ticket)(const krb5_data *, krb5_ticket **);
+	krb5_error_code (*krb5_server_decrypt_ticket_keytab)(krb5_context, const krb5_keytab, krb5_ticket *);
+	void (*krb5_free_ticket)(krb5_context, krb5_ticket *);
+	void (*krb5_free_creds)(krb5_context, krb5_creds *);
+	void (*krb5_free_cred_contents)(krb5_context, krb5_creds *);
+	krb5_error_code (*krb5_cc_get_principal)(krb5_context, krb5_ccache, krb5_principal *);
+	krb5_error_code (*krb5_cc_start_seq_get)(krb5_context, krb5_ccache, krb5_cc_cursor *);
+	krb5_error_code (*krb5_cc_next_cred)(krb5_context, krb5_ccache, krb5_cc_cursor *, krb5_creds *);
+	krb5_error_code (*krb5_cc_end_seq_get)(krb5_context, krb5_ccache, krb5_cc_cursor *);
+	krb5_error_code (*krb5_unparse_name)(krb5_context, krb5_const_principal, char **);
+	void (*krb5_free_unparsed_name)(krb5_context, char *);
+	krb5_error_code (*krb5_get_renewed_creds)(krb5_context, krb5_creds *, krb5_principal,
+		krb5_ccache, const char *);
+	krb5_error_code (*krb5_cc_copy_creds)(krb5_context, krb5_ccache, krb5_ccache);
+	krb5_error_code (*krb5_cc_switch)(krb5_context, krb5_ccache);
+	krb5_error_code (*krb5_cc_get_full_name)(krb5_context, krb5_ccache, char **);
+	void (*krb5_free_string)(krb5_context, char *);
+} ft;
+
+static char *
+kfs_krb5_load(const char *path)
+{
+	void *h = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (h == NULL)
+		return strdup(dlerror());
+
+#define LOAD(f) if ((*(void **)&ft.f = dlsym(h, #f)) == NULL) return strdup(dlerror());
+	LOAD(krb5_init_context)
+	LOAD(krb5_free_context)
+	LOAD(krb5_get_error_message)
+	LOAD(krb5_free_error_message)
+	LOAD(krb5_parse_name)
+	LOAD(krb5_free_principal)
+	LOAD(krb5_kt_resolve)
+	LOAD(krb5_kt_close)
+	LOAD(krb5_get_init_creds_opt_alloc)
+	LOAD(krb5_get_init_creds_opt_free)
+	LOAD(krb5_get_init_creds_opt_set_forwardable)
+	LOAD(krb5_get_init_creds_keytab)
+	LOAD(krb5_cc_new_unique)
+	LOAD(krb5_cc_resolve)
+	LOAD(krb5_cc_initialize)
+	LOAD(krb5_cc_store_cred)
+	LOAD(krb5_cc_close)
+	LOAD(krb5_cc_destroy)
+	LOAD(krb5_get_credentials_for_user)
+	LOAD(krb5_get_credentials_for_proxy)
+	LOAD(krb5_decode_ticket)
+	LOAD(krb5_server_decrypt_ticket_keytab)
+	LOAD(krb5_free_ticket)
+	LOAD(krb5_free_creds)
+	LOAD(krb5_free_cred_contents)
+	LOAD(krb5_cc_get_principal)
+	LOAD(krb5_cc_start_seq_get)
+	LOAD(krb5_cc_next_cred)
+	LOAD(krb5_cc_end_seq_get)
+	LOAD(krb5_unparse_name)
+	LOAD(krb5_free_unparsed_name)
+	LOAD(krb5_get_renewed_creds)
+	LOAD(krb5_cc_copy_creds)
+	LOAD(krb5_cc_switch)
+	LOAD(krb5_cc_get_full_name)
+	LOAD(krb5_free_string)
+#undef LOAD
+
+	return NULL;
+}
+
+// kfs_krb5_error returns a newly allocated error message.
+static char *
+kfs_krb5_error(krb5_context ctx, krb5_error_code code, const char *what)
+{
+	const char *msg = ft.krb5_get_error_message(ctx, code);
+	size_t len = strlen(what) + strlen(msg) + 3;
+	char *s = malloc(len);
+
+	if (s != NULL)
+		snprintf(s, len, "%s: %s", what, msg);
+	ft.krb5_free_error_message(ctx, msg);
+	return s;
+}
+
+#define CHECK(what) if (ret) { err = kfs_krb5_error(ctx, ret, what); goto cleanup; }
+
+// kfs_krb5_impersonate gets with the keytab a TGT for the impersonator, then
+// a S4U2Self ticket for the user and S4U2Proxy tickets for the user to the
+// targets. Only the S4U2Proxy tickets are stored in the out credential cache
+// whose principal is the user. It returns NULL or an error message to free.
+static char *
+kfs_krb5_impersonate(const char *keytab, const char *impersonator, const char *user,
+	char **targets, int ntargets, const char *out, krb5_timestamp *endtime)
+{
+	krb5_context ctx = NULL;
+	krb5_principal svc = NULL, uprinc = NULL, tprinc = NULL;
+	krb5_keytab kt = NULL;
+	krb5_get_init_creds_opt *opt = NULL;
+	krb5_ccache mcc = NULL, occ = NULL;
+	krb5_creds tgt, in, *evidence = NULL, *proxy = NULL;
+	krb5_ticket *evidence_tkt = NULL;
+	krb5_error_code ret;
+	char *err = NULL;
+	int i;
+
+	memset(&tgt, 0, sizeof(tgt));
+	*endtime = 0;
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_parse_name(ctx, impersonator, &svc);
+	CHECK("parsing impersonator principal")
+	ret = ft.krb5_parse_name(ctx, user, &uprinc);
+	CHECK("parsing user principal")
+	ret = ft.krb5_kt_resolve(ctx, keytab, &kt);
+	CHECK("resolving keytab")
+	ret = ft.krb5_get_init_creds_opt_alloc(ctx, &opt);
+	CHECK("allocating options")
+	ft.krb5_get_init_creds_opt_set_forwardable(opt, 1);
+	ret = ft.krb5_get_init_creds_keytab(ctx, &tgt, svc, kt, 0, NULL, opt);
+	CHECK("getting impersonator TGT")
+
+	ret = ft.krb5_cc_new_unique(ctx, "MEMORY", NULL, &mcc);
+	CHECK("creating memory credential cache")
+	ret = ft.krb5_cc_initialize(ctx, mcc, svc);
+	CHECK("initializing memory credential cache")
+	ret = ft.krb5_cc_store_cred(ctx, mcc, &tgt);
+	CHECK("storing impersonator TGT")
+
+	memset(&in, 0, sizeof(in));
+	in.client = uprinc;
+	in.server = svc;
+	ret = ft.krb5_get_credentials_for_user(ctx, KRB5_GC_FORWARDABLE | KRB5_GC_NO_STORE,
+		mcc, &in, NULL, &evidence);
+	CHECK("S4U2Self")
+	ret = ft.krb5_decode_ticket(&evidence->ticket, &evidence_tkt);
+	CHECK("decoding evidence ticket")
+	ret = ft.krb5_server_decrypt_ticket_keytab(ctx, kt, evidence_tkt);
+	CHECK("decrypting evidence ticket")
+
+	ret = ft.krb5_cc_resolve(ctx, out, &occ);
+	CHECK("resolving user credential cache")
+	ret = ft.krb5_cc_initialize(ctx, occ, evidence->client);
+	CHECK("initializing user credential cache")
+
+	for (i = 0; i < ntargets; i++) {
+		ret = ft.krb5_parse_name(ctx, targets[i], &tprinc);
+		CHECK("parsing target principal")
+		memset(&in, 0, sizeof(in));
+		in.client = evidence->client;
+		in.server = tprinc;
+		ret = ft.krb5_get_credentials_for_proxy(ctx, KRB5_GC_NO_STORE, mcc, &in,
+			evidence_tkt, &proxy);
+		CHECK("S4U2Proxy")
+		ret = ft.krb5_cc_store_cred(ctx, occ, proxy);
+		CHECK("storing S4U2Proxy ticket")
+		if (*endtime == 0 || proxy->times.endtime < *endtime)
+			*endtime = proxy->times.endtime;
+		ft.krb5_free_creds(ctx, proxy);
+		proxy = NULL;
+		ft.krb5_free_principal(ctx, tprinc);
+		tprinc = NULL;
+	}
+
+cleanup:
+	if (proxy != NULL)
+		ft.krb5_free_creds(ctx, proxy);
+	if (tprinc != NULL)
+		ft.krb5_free_principal(ctx, tprinc);
+	if (occ != NULL) {
+		if (err != NULL)
+			ft.krb5_cc_destroy(ctx, occ);
+		else
+			ft.krb5_cc_close(ctx, occ);
+	}
+	if (evidence_tkt != NULL)
+		ft.krb5_free_ticket(ctx, evidence_tkt);
+	if (evidence != NULL)
+		ft.krb5_free_creds(ctx, evidence);
+	if (mcc != NULL)
+		ft.krb5_cc_destroy(ctx, mcc);
+	ft.krb5_free_cred_contents(ctx, &tgt);
+	if (opt != NULL)
+		ft.krb5_get_init_creds_opt_free(ctx, opt);
+	if (kt != NULL)
+		ft.krb5_kt_close(ctx, kt);
+	if (uprinc != NULL)
+		ft.krb5_free_principal(ctx, uprinc);
+	if (svc != NULL)
+		ft.krb5_free_principal(ctx, svc);
+	ft.krb5_free_context(ctx);
+	return err;
+}
+
+// kfs_krb5_tgt_times returns the times and flags of the TGT of the default
+// principal of the credential cache. It returns NULL or an error message to
+// free.
+static char *
+kfs_krb5_tgt_times(const char *ccache, krb5_timestamp *endtime, krb5_timestamp *renew_till,
+	krb5_flags *flags)
+{
+	krb5_context ctx = NULL;
+	krb5_ccache cc = NULL;
+	krb5_principal client = NULL;
+	krb5_cc_cursor cursor;
+	krb5_creds creds;
+	krb5_error_code ret;
+	char *cname = NULL, *sname = NULL, *tgtname = NULL, *realm;
+	char *err = NULL;
+	int found = 0, seq = 0;
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_cc_resolve(ctx, ccache, &cc);
+	CHECK("resolving credential cache")
+	ret = ft.krb5_cc_get_principal(ctx, cc, &client);
+	CHECK("getting credential cache principal")
+	ret = ft.krb5_unparse_name(ctx, client, &cname);
+	CHECK("unparsing principal")
+
+	realm = strrchr(cname, '@');
+	if (realm == NULL) {
+		err = strdup("principal without realm");
+		goto cleanup;
+	}
+	realm++;
+	tgtname = malloc(2 * strlen(realm) + 9);
+	if (tgtname == NULL) {
+		err = strdup("cannot allocate memory");
+		goto cleanup;
+	}
+	sprintf(tgtname, "krbtgt/%s@%s", realm, realm);
+
+	ret = ft.krb5_cc_start_seq_get(ctx, cc, &cursor);
+	CHECK("reading credential cache")
+	seq = 1;
+	while (!found && (ret = ft.krb5_cc_next_cred(ctx, cc, &cursor, &creds)) == 0) {
+		if (ft.krb5_unparse_name(ctx, creds.server, &sname) == 0) {
+			if (strcmp(sname, tgtname) == 0) {
+				*endtime = creds.times.endtime;
+				*renew_till = creds.times.renew_till;
+				*flags = creds.ticket_flags;
+				found = 1;
+			}
+			ft.krb5_free_unparsed_name(ctx, sname);
+		}
+		ft.krb5_free_cred_contents(ctx, &creds);
+	}
+	if (!found)
+		err = strdup("no TGT found in credential cache");
+
+cleanup:
+	if (seq)
+		ft.krb5_cc_end_seq_get(ctx, cc, &cursor);
+	free(tgtname);
+	if (cname != NULL)
+		ft.krb5_free_unparsed_name(ctx, cname);
+	if (client != NULL)
+		ft.krb5_free_principal(ctx, client);
+	if (cc != NULL)
+		ft.krb5_cc_close(ctx, cc);
+	ft.krb5_free_context(ctx);
+	return err;
+}
+
+// kfs_krb5_renew renews the TGT of the in credential cache and stores it in
+// the out credential cache. It returns NULL or an error message to free.
+static char *
+kfs_krb5_renew(const char *in, const char *out, krb5_timestamp *endtime, krb5_timestamp *renew_till)
+{
+	krb5_context ctx = NULL;
+	krb5_ccache icc = NULL, occ = NULL;
+	krb5_principal client = NULL;
+	krb5_creds creds;
+	krb5_error_code ret;
+	char *err = NULL;
+
+	memset(&creds, 0, sizeof(creds));
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_cc_resolve(ctx, in, &icc);
+	CHECK("resolving credential cache")
+	ret = ft.krb5_cc_get_principal(ctx, icc, &client);
+	CHECK("getting credential cache principal")
+	ret = ft.krb5_get_renewed_creds(ctx, &creds, client, icc, NULL);
+	CHECK("renewing TGT")
+
+	ret = ft.krb5_cc_resolve(ctx, out, &occ);
+	CHECK("resolving new credential cache")
+	ret = ft.krb5_cc_initialize(ctx, occ, client);
+	CHECK("initializing new credential cache")
+	ret = ft.krb5_cc_store_cred(ctx, occ, &creds);
+	CHECK("storing renewed TGT")
+
+	*endtime = creds.times.endtime;
+	*renew_till = creds.times.renew_till;
+
+cleanup:
+	if (occ != NULL) {
+		if (err != NULL)
+			ft.krb5_cc_destroy(ctx, occ);
+		else
+			ft.krb5_cc_close(ctx, occ);
+	}
+	ft.krb5_free_cred_contents(ctx, &creds);
+	if (client != NULL)
+		ft.krb5_free_principal(ctx, client);
+	if (icc != NULL)
+		ft.krb5_cc_close(ctx, icc);
+	ft.krb5_free_context(ctx);
+	return err;
+}
+
+// kfs_krb5_new_unique creates a new unique credential cache of the type in the
+// default collection and returns its newly allocated name. It returns NULL or
+// an error message to free.
+static char *
+kfs_krb5_new_unique(const char *type, char **name)
+{
+	krb5_context ctx = NULL;
+	krb5_ccache cc = NULL;
+	krb5_error_code ret;
+	char *fullname = NULL;
+	char *err = NULL;
+
+	*name = NULL;
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_cc_new_unique(ctx, type, NULL, &cc);
+	CHECK("creating credential cache")
+	ret = ft.krb5_cc_get_full_name(ctx, cc, &fullname);
+	CHECK("getting credential cache name")
+	*name = strdup(fullname);
+	if (*name == NULL)
+		err = strdup("cannot allocate memory");
+
+cleanup:
+	if (fullname != NULL)
+		ft.krb5_free_string(ctx, fullname);
+	if (cc != NULL) {
+		if (err != NULL)
+			ft.krb5_cc_destroy(ctx, cc);
+		else
+			ft.krb5_cc_close(ctx, cc);
+	}
+	ft.krb5_free_context(ctx);
+	return err;
+}
+
+// kfs_krb5_copy copies the credentials of the in credential cache to the out
+// credential cache. It returns NULL or an error message to free.
+static char *
+kfs_krb5_copy(const char *in, const char *out)
+{
+	krb5_context ctx = NULL;
+	krb5_ccache icc = NULL, occ = NULL;
+	krb5_principal client = NULL;
+	krb5_error_code ret;
+	char *err = NULL;
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_cc_resolve(ctx, in, &icc);
+	CHECK("resolving credential cache")
+	ret = ft.krb5_cc_get_principal(ctx, icc, &client);
+	CHECK("getting credential cache principal")
+	ret = ft.krb5_cc_resolve(ctx, out, &occ);
+	CHECK("resolving new credential cache")
+	ret = ft.krb5_cc_initialize(ctx, occ, client);
+	CHECK("initializing new credential cache")
+	ret = ft.krb5_cc_copy_creds(ctx, icc, occ);
+	CHECK("copying credentials")
+
+cleanup:
+	if (occ != NULL)
+		ft.krb5_cc_close(ctx, occ);
+	if (client != NULL)
+		ft.krb5_free_principal(ctx, client);
+	if (icc != NULL)
+		ft.krb5_cc_close(ctx, icc);
+	ft.krb5_free_context(ctx);
+	return err;
+}
+
+// kfs_krb5_switch makes the credential cache the primary one of its
+// collection. It returns NULL or an error message to free.
+static char *
+kfs_krb5_switch(const char *name)
+{
+	krb5_context ctx = NULL;
+	krb5_ccache cc = NULL;
+	krb5_error_code ret;
+	char *err = NULL;
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_cc_resolve(ctx, name, &cc);
+	CHECK("resolving credential cache")
+	ret = ft.krb5_cc_switch(ctx, cc);
+	CHECK("switching credential cache")
+
+cleanup:
+	if (cc != NULL)
+		ft.krb5_cc_close(ctx, cc);
+	ft.krb5_free_context(ctx);
+	return err;
+}
+
+// kfs_krb5_destroy destroys the credential cache. It returns NULL or an error
+// message to free.
+static char *
+kfs_krb5_destroy(const char *name)
+{
+	krb5_context ctx = NULL;
+	krb5_ccache cc = NULL;
+	krb5_error_code ret;
+	char *err = NULL;
+
+	ret = ft.krb5_init_context(&ctx);
+	if (ret)
+		return strdup("cannot initialize Kerberos context");
+
+	ret = ft.krb5_cc_resolve(ctx, name, &cc);
+	CHECK("resolving credential cache")
+	ret = ft.krb5_cc_destroy(ctx, cc);
+	cc = NULL;
+	CHECK("destroying credential cache")
+
+cleanup:
+	if (cc != NULL)
+		ft.krb5_cc_close(ctx, cc);
+	ft.krb5_free_context(ctx);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
+
+var defaultKrb5Lib = "libkrb5.so.3"
+
+// cError converts an error message returned by a C helper function to a Go
+// error and frees it.
+func cError(msg *C.char) error {
+	if msg == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(msg))
+	return errors.New(C.GoString(msg))
+}
+
+// LoadKrb5 loads the Kerberos 5 library. It must be called before any other
+// function of this file.
+func LoadKrb5(path string) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	return cError(C.kfs_krb5_load(cPath))
+}
+
+// Impersonate obtains with constrained delegation (S4U2Self then S4U2Proxy)
+// tickets for the user to the target service principals, using the
+// impersonator credentials from the keytab. The tickets are stored in the
+// provided credential cache. It returns the expiration time of the tickets
+// or an error if any.
+func Impersonate(keytab, impersonator, user string, targets []string, ccache string) (time.Time, error) {
+	if len(targets) == 0 {
+		return time.Time{}, errors.New("no target service principal")
+	}
+
+	cKeytab := C.CString(keytab)
+	defer C.free(unsafe.Pointer(cKeytab))
+	cImpersonator := C.CString(impersonator)
+	defer C.free(unsafe.Pointer(cImpersonator))
+	cUser := C.CString(user)
+	defer C.free(unsafe.Pointer(cUser))
+	cCcache := C.CString(ccache)
+	defer C.free(unsafe.Pointer(cCcache))
+
+	cTargets := C.malloc(C.size_t(len(targets)) * C.size_t(unsafe.Sizeof(uintptr(0))))
+	defer C.free(cTargets)
+	targetsArray := (*[1 << 20]*C.char)(cTargets)[:len(targets):len(targets)]
+	for i, target := range targets {
+		targetsArray[i] = C.CString(target)
+		defer C.free(unsafe.Pointer(targetsArray[i]))
+	}
+
+	var endtime C.krb5_timestamp
+	if err := cError(C.kfs_krb5_impersonate(cKeytab, cImpersonator, cUser,
+		(**C.char)(cTargets), C.int(len(targets)), cCcache, &endtime)); err != nil {
+		return time.Time{}, err
+	}
+
+	return krb5Time(endtime), nil
+}
+
+// krb5Time converts a Kerberos timestamp.
+func krb5Time(t C.krb5_timestamp) time.Time {
+	return time.Unix(int64(uint32(t)), 0)
+}
+
+// TGTTimes returns the expiration time of the TGT stored in the credential
+// cache and, if it is renewable, the time until which it can be renewed (zero
+// otherwise).
+func TGTTimes(ccache string) (time.Time, time.Time, error) {
+	cCcache := C.CString(ccache)
+	defer C.free(unsafe.Pointer(cCcache))
+
+	var endtime, renewTill C.krb5_timestamp
+	var flags C.krb5_flags
+	if err := cError(C.kfs_krb5_tgt_times(cCcache, &endtime, &renewTill, &flags)); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if flags&C.TKT_FLG_RENEWABLE == 0 {
+		return krb5Time(endtime), time.Time{}, nil
+	}
+
+	return krb5Time(endtime), krb5Time(renewTill), nil
+}
+
+// RenewTGT renews the TGT stored in the in credential cache and stores it in
+// the out credential cache. It returns the new expiration time of the TGT or
+// an error if any.
+func RenewTGT(in, out string) (time.Time, error) {
+	cIn := C.CString(in)
+	defer C.free(unsafe.Pointer(cIn))
+	cOut := C.CString(out)
+	defer C.free(unsafe.Pointer(cOut))
+
+	var endtime, renewTill C.krb5_timestamp
+	if err := cError(C.kfs_krb5_renew(cIn, cOut, &endtime, &renewTill)); err != nil {
+		return time.Time{}, err
+	}
+
+	return krb5Time(endtime), nil
+}
+
+// NewUniqueCcache creates a new unique credential cache of the type in the
+// default collection (selected by KRB5CCNAME) and returns its name.
+func NewUniqueCcache(ccacheType string) (string, error) {
+	cType := C.CString(ccacheType)
+	defer C.free(unsafe.Pointer(cType))
+
+	var cName *C.char
+	if err := cError(C.kfs_krb5_new_unique(cType, &cName)); err != nil {
+		return "", err
+	}
+	defer C.free(unsafe.Pointer(cName))
+
+	return C.GoString(cName), nil
+}
+
+// CopyCcache copies the credentials of the in credential cache to the out
+// credential cache.
+func CopyCcache(in, out string) error {
+	cIn := C.CString(in)
+	defer C.free(unsafe.Pointer(cIn))
+	cOut := C.CString(out)
+	defer C.free(unsafe.Pointer(cOut))
+
+	return cError(C.kfs_krb5_copy(cIn, cOut))
+}
+
+// SwitchCcache makes the credential cache the primary one of its collection.
+func SwitchCcache(ccache string) error {
+	cCcache := C.CString(ccache)
+	defer C.free(unsafe.Pointer(cCcache))
+
+	return cError(C.kfs_krb5_switch(cCcache))
+}
+
+// DestroyCcache destroys the credential cache.
+func DestroyCcache(ccache string) error {
+	cCcache := C.CString(ccache)
+	defer C.free(unsafe.Pointer(cCcache))
+
+	return cError(C.kfs_krb5_destroy(cCcache))
+}
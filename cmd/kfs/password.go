@@ -0,0 +1,301 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cea-hpc/gssapi"
+)
+
+var (
+	defaultMaxFailures = 5
+	defaultBaseDelay   = time.Second
+	defaultMaxDelay    = 30 * time.Second
+	defaultBanDuration = 15 * time.Minute
+	defaultResetAfter  = 15 * time.Minute
+)
+
+// Interval between purges of expired failure records.
+const throttlePurgeInterval = time.Minute
+
+// errPasswordAuth is returned when the password authentication failed.
+var errPasswordAuth = errors.New("password authentication failed")
+
+// throttledError is returned when a password authentication is refused
+// because of previous failures.
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("too many failures, retry after %s", e.retryAfter)
+}
+
+// passwordAuthenticator authenticates users with their password. It is
+// implemented by spnego.KerberizedServer.
+type passwordAuthenticator interface {
+	AuthenticateUserWithPassword(user, pass string) (*gssapi.CredId, error)
+}
+
+// throttleConfig defines the protection against password brute-force attacks.
+type throttleConfig struct {
+	Disabled    bool          // disable the protection
+	MaxFailures int           `yaml:"max_failures"` // failures before a ban
+	BaseDelay   time.Duration `yaml:"base_delay"`   // delay after the first failure
+	MaxDelay    time.Duration `yaml:"max_delay"`    // maximum delay between failures
+	BanDuration time.Duration `yaml:"ban_duration"` // duration of a ban
+	ResetAfter  time.Duration `yaml:"reset_after"`  // failures are forgotten after this period
+}
+
+// init sets default values and checks the configuration.
+func (c *throttleConfig) init() error {
+	if c.MaxFailures == 0 {
+		c.MaxFailures = defaultMaxFailures
+	}
+	if c.BaseDelay == 0 {
+		c.BaseDelay = defaultBaseDelay
+	}
+	if c.MaxDelay == 0 {
+		c.MaxDelay = defaultMaxDelay
+	}
+	if c.BanDuration == 0 {
+		c.BanDuration = defaultBanDuration
+	}
+	if c.ResetAfter == 0 {
+		c.ResetAfter = defaultResetAfter
+	}
+
+	if c.MaxFailures < 0 || c.BaseDelay < 0 || c.MaxDelay < 0 || c.BanDuration < 0 || c.ResetAfter < 0 {
+		return errors.New("password throttle parameters cannot be negative numbers")
+	}
+
+	return nil
+}
+
+// failureRecord records the authentication failures of a username or a
+// client.
+type failureRecord struct {
+	count     int       // number of consecutive failures
+	last      time.Time // time of the last failure
+	notBefore time.Time // no authentication is allowed before
+}
+
+// A throttle delays password authentications after failures: each failure
+// doubles the delay before the next allowed attempt and too many failures
+// lead to a temporary ban. A nil throttle allows everything.
+type throttle struct {
+	sync.Mutex
+	cfg       *throttleConfig
+	records   map[string]*failureRecord
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+func newThrottle(cfg *throttleConfig) *throttle {
+	if cfg.Disabled {
+		return nil
+	}
+	return &throttle{
+		cfg:     cfg,
+		records: make(map[string]*failureRecord),
+		now:     time.Now,
+	}
+}
+
+// delay returns the delay before the next attempt after count failures.
+func (t *throttle) delay(count int) time.Duration {
+	if count >= t.cfg.MaxFailures {
+		return t.cfg.BanDuration
+	}
+
+	delay := t.cfg.BaseDelay
+	for i := 1; i < count && delay < t.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.cfg.MaxDelay {
+		delay = t.cfg.MaxDelay
+	}
+
+	return delay
+}
+
+// purge removes expired records. It must be called with the lock held.
+func (t *throttle) purge(now time.Time) {
+	if now.Sub(t.lastPurge) < throttlePurgeInterval {
+		return
+	}
+	t.lastPurge = now
+
+	for key, record := range t.records {
+		if now.After(record.notBefore) && now.Sub(record.last) > t.cfg.ResetAfter {
+			delete(t.records, key)
+		}
+	}
+}
+
+// retryAfter returns how long the caller must wait before an authentication
+// is allowed for all the provided keys.
+func (t *throttle) retryAfter(keys ...string) time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	t.purge(now)
+
+	var wait time.Duration
+	for _, key := range keys {
+		if record, ok := t.records[key]; ok && record.notBefore.After(now) {
+			if d := record.notBefore.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait
+}
+
+// failure records an authentication failure for the provided keys. It
+// returns true if one of them is now banned.
+func (t *throttle) failure(keys ...string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	banned := false
+	for _, key := range keys {
+		record, ok := t.records[key]
+		if !ok || now.Sub(record.last) > t.cfg.ResetAfter {
+			record = &failureRecord{}
+			t.records[key] = record
+		}
+		record.count++
+		record.last = now
+		record.notBefore = now.Add(t.delay(record.count))
+		if record.count >= t.cfg.MaxFailures {
+			record.count = 0
+			banned = true
+		}
+	}
+
+	return banned
+}
+
+// success forgets the failures of the provided keys.
+func (t *throttle) success(keys ...string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	for _, key := range keys {
+		delete(t.records, key)
+	}
+}
+
+// clientHost returns the host part of a remote address.
+func clientHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// passwordLogin authenticates the user with a password. If the username has
+// no realm, the default trusted realms are tried sequentially. It returns the
+// Kerberos username (ie. login@REALM) and the acquired credentials, or
+// errPasswordAuth or a *throttledError. Failures are counted for the client
+// and for each tried Kerberos principal, whatever the spelling of the
+// username.
+func passwordLogin(auth passwordAuthenticator, t *throttle, realms *realmPolicy, username, pass, client string) (string, *gssapi.CredId, error) {
+	usernames := []string{}
+	if !strings.Contains(username, "@") && len(realms.Default) != 0 {
+		for _, realm := range realms.Default {
+			usernames = append(usernames, fmt.Sprintf("%s@%s", username, realm))
+		}
+	} else {
+		usernames = append(usernames, username)
+	}
+
+	keys := []string{"client:" + client}
+	for _, krbusername := range usernames {
+		keys = append(keys, "user:"+strings.ToLower(krbusername))
+	}
+
+	// The username is quoted: it is chosen by the client and must not
+	// forge fields of the log line.
+	if wait := t.retryAfter(keys...); wait > 0 {
+		log.Printf("AUTH-BLOCKED: user=%q client=%s retry_after=%s", username, client, wait)
+		return "", nil, &throttledError{wait}
+	}
+
+	for _, krbusername := range usernames {
+		// Do not send passwords for untrusted realms to the KDC.
+		if err := realms.check(krbusername); err != nil {
+			log.Printf("ERROR: rejecting password login: %v", err)
+			continue
+		}
+		cred, err := auth.AuthenticateUserWithPassword(krbusername, pass)
+		if err == nil {
+			t.success(keys...)
+			return krbusername, cred, nil
+		}
+	}
+
+	banned := t.failure(keys...)
+	log.Printf("AUTH-FAILURE: user=%q client=%s banned=%t", username, client, banned)
+
+	return "", nil, errPasswordAuth
+}
+
+// basicLogin authenticates the request with the username and password of its
+// Basic authentication header. If the login fails, it answers the request and
+// returns false.
+func basicLogin(w http.ResponseWriter, r *http.Request, auth passwordAuthenticator, t *throttle, realms *realmPolicy) (string, *gssapi.CredId, bool) {
+	username, pass, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		w.Header().Add("WWW-Authenticate", `Basic realm="Please enter your username and password."`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	krbusername, cred, err := passwordLogin(auth, t, realms, username, pass, clientHost(r.RemoteAddr))
+	if err == nil {
+		return krbusername, cred, true
+	}
+	if terr, ok := err.(*throttledError); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(terr.retryAfter.Seconds())))
+		http.Error(w, "Too many failed login attempts: retry later.", http.StatusTooManyRequests)
+		return "", nil, false
+	}
+	log.Printf("ERROR: cannot authenticate user %q with password", username)
+	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	return "", nil, false
+}
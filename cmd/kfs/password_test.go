@@ -0,0 +1,209 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/gssapi"
+)
+
+// fakeAuthenticator accepts the passwords of its principals.
+type fakeAuthenticator struct {
+	passwords map[string]string // by Kerberos username
+	tried     []string          // Kerberos usernames of the attempts
+}
+
+func (a *fakeAuthenticator) AuthenticateUserWithPassword(user, pass string) (*gssapi.CredId, error) {
+	a.tried = append(a.tried, user)
+	if p, ok := a.passwords[user]; ok && p == pass {
+		return &gssapi.CredId{}, nil
+	}
+	return nil, errors.New("wrong password")
+}
+
+// fakeClock is the time of a throttle under test.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newTestThrottle returns a throttle with the default configuration using
+// the clock.
+func newTestThrottle(t *testing.T, clock *fakeClock) *throttle {
+	cfg := &throttleConfig{}
+	if err := cfg.init(); err != nil {
+		t.Fatal(err)
+	}
+	th := newThrottle(cfg)
+	th.now = func() time.Time { return clock.now }
+	return th
+}
+
+// captureLog returns the buffer where the log is written until the end of the
+// test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestPasswordLoginDefaultRealms(t *testing.T) {
+	captureLog(t)
+	auth := &fakeAuthenticator{passwords: map[string]string{"bob@REALM2": "secret"}}
+	realms := &realmPolicy{Accept: []string{"REALM1", "REALM2"}, Default: []string{"REALM1", "REALM2"}}
+
+	krbusername, cred, err := passwordLogin(auth, nil, realms, "bob", "secret", "192.0.2.1")
+	if err != nil || cred == nil {
+		t.Fatalf("passwordLogin() failed: %v", err)
+	}
+	if krbusername != "bob@REALM2" {
+		t.Errorf("krbusername = %q, want bob@REALM2", krbusername)
+	}
+	if want := []string{"bob@REALM1", "bob@REALM2"}; strings.Join(auth.tried, ",") != strings.Join(want, ",") {
+		t.Errorf("tried %v, want %v", auth.tried, want)
+	}
+}
+
+func TestPasswordLoginUntrustedRealm(t *testing.T) {
+	captureLog(t)
+	auth := &fakeAuthenticator{passwords: map[string]string{"bob@EVIL": "secret"}}
+	realms := &realmPolicy{Accept: []string{"REALM"}, Default: []string{"REALM"}}
+
+	if _, _, err := passwordLogin(auth, nil, realms, "bob@EVIL", "secret", "192.0.2.1"); err != errPasswordAuth {
+		t.Fatalf("passwordLogin() error = %v, want errPasswordAuth", err)
+	}
+	if len(auth.tried) != 0 {
+		t.Errorf("password sent to the KDC for %v", auth.tried)
+	}
+}
+
+func TestPasswordLoginThrottle(t *testing.T) {
+	captureLog(t)
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	th := newTestThrottle(t, clock)
+	auth := &fakeAuthenticator{passwords: map[string]string{"bob@REALM": "secret"}}
+	realms := &realmPolicy{Accept: []string{"REALM"}, Default: []string{"REALM"}}
+
+	// The delay doubles at each failure.
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if _, _, err := passwordLogin(auth, th, realms, "bob", "wrong", "192.0.2.1"); err != errPasswordAuth {
+			t.Fatalf("attempt %d: error = %v, want errPasswordAuth", i, err)
+		}
+		_, _, err := passwordLogin(auth, th, realms, "bob", "secret", "192.0.2.1")
+		terr, ok := err.(*throttledError)
+		if !ok || terr.retryAfter != delay {
+			t.Fatalf("attempt %d: error = %v, want retry after %s", i, err, delay)
+		}
+		clock.advance(delay)
+	}
+
+	// A success forgets the failures.
+	if _, _, err := passwordLogin(auth, th, realms, "bob", "secret", "192.0.2.1"); err != nil {
+		t.Fatalf("passwordLogin() failed: %v", err)
+	}
+	if _, _, err := passwordLogin(auth, th, realms, "bob", "wrong", "192.0.2.1"); err != errPasswordAuth {
+		t.Fatalf("error = %v, want errPasswordAuth", err)
+	}
+	if wait := th.retryAfter("user:bob@realm"); wait != time.Second {
+		t.Errorf("retryAfter() = %s after a success and a failure, want 1s", wait)
+	}
+}
+
+func TestPasswordLoginBan(t *testing.T) {
+	captureLog(t)
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	th := newTestThrottle(t, clock)
+	auth := &fakeAuthenticator{passwords: map[string]string{"bob@REALM": "secret"}}
+	realms := &realmPolicy{Accept: []string{"REALM"}, Default: []string{"REALM"}}
+
+	// Both spellings of the principal share the same counter.
+	for i := 0; i < th.cfg.MaxFailures; i++ {
+		username := "bob"
+		if i%2 == 1 {
+			username = "bob@REALM"
+		}
+		if _, _, err := passwordLogin(auth, th, realms, username, "wrong", "192.0.2.1"); err != errPasswordAuth {
+			t.Fatalf("attempt %d: error = %v, want errPasswordAuth", i, err)
+		}
+		clock.advance(th.cfg.MaxDelay)
+	}
+
+	// The principal is banned, even from another client.
+	_, _, err := passwordLogin(auth, th, realms, "bob@REALM", "secret", "192.0.2.2")
+	if _, ok := err.(*throttledError); !ok {
+		t.Fatalf("error = %v, want a ban", err)
+	}
+	clock.advance(th.cfg.BanDuration)
+	if _, _, err := passwordLogin(auth, th, realms, "bob", "secret", "192.0.2.2"); err != nil {
+		t.Fatalf("passwordLogin() failed after the ban: %v", err)
+	}
+}
+
+func TestPasswordLoginLogFields(t *testing.T) {
+	buf := captureLog(t)
+	auth := &fakeAuthenticator{}
+	realms := &realmPolicy{}
+
+	passwordLogin(auth, nil, realms, "x client=198.51.100.7 banned=true\nAUTH-FAILURE: user=y", "wrong", "192.0.2.1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("username forged log lines: %q", buf.String())
+	}
+	if !strings.HasSuffix(lines[0], `\nAUTH-FAILURE: user=y" client=192.0.2.1 banned=false`) {
+		t.Errorf("unexpected log line: %s", lines[0])
+	}
+}
+
+func TestBasicLoginLogFields(t *testing.T) {
+	// Basic authentication usernames cannot contain colons.
+	forged := "x\n2006/01/02 15:04:05 AUTH-FAILURE user=y client=198.51.100.7 banned=true"
+	logLine := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d (AUTH|ERROR)`)
+	for _, tc := range []struct {
+		name     string
+		realms   *realmPolicy
+		username string
+	}{
+		{"any realm", &realmPolicy{}, forged},
+		{"untrusted realm", &realmPolicy{Accept: []string{"REALM"}}, forged + "@EVIL"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := captureLog(t)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.SetBasicAuth(tc.username, "wrong")
+			w := httptest.NewRecorder()
+
+			if _, _, ok := basicLogin(w, r, &fakeAuthenticator{}, nil, tc.realms); ok {
+				t.Fatal("basicLogin() succeeded")
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", w.Code)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if !logLine.MatchString(line) || strings.Contains(line, "client=198.51.100.7") && !strings.Contains(line, `\n`) {
+					t.Errorf("username forged a log line: %q", line)
+				}
+			}
+		})
+	}
+}
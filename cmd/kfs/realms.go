@@ -0,0 +1,90 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// realmPolicy defines the Kerberos realms trusted to authenticate users.
+type realmPolicy struct {
+	Accept  []string // realms whose principals are accepted
+	Default []string // realms used to qualify bare usernames in password logins
+}
+
+// init fills the policy from the deprecated realms list and checks its
+// consistency.
+func (p *realmPolicy) init(realms []string) error {
+	if len(p.Default) == 0 {
+		p.Default = realms
+	} else if len(realms) != 0 {
+		return fmt.Errorf("realms and trusted_realms.default cannot be both set")
+	}
+
+	if len(p.Accept) == 0 {
+		p.Accept = p.Default
+	}
+
+	for _, realm := range p.Default {
+		if !p.accepts(realm) {
+			return fmt.Errorf("default realm %s is not in trusted_realms.accept", realm)
+		}
+	}
+
+	return nil
+}
+
+// acceptsAny returns true if no realm restriction is configured.
+func (p *realmPolicy) acceptsAny() bool {
+	return len(p.Accept) == 0
+}
+
+// accepts returns true if principals of the provided realm are trusted.
+func (p *realmPolicy) accepts(realm string) bool {
+	if p.acceptsAny() {
+		return true
+	}
+	for _, r := range p.Accept {
+		if r == realm {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error describing why the provided Kerberos username (ie.
+// login@REALM) is rejected by the policy or nil if it is accepted.
+func (p *realmPolicy) check(krbusername string) error {
+	if p.acceptsAny() {
+		return nil
+	}
+
+	realm := principalRealm(krbusername)
+	if realm == "" {
+		return fmt.Errorf("principal %q has no realm", krbusername)
+	}
+
+	if !p.accepts(realm) {
+		return fmt.Errorf("realm %q of principal %q is not trusted", realm, krbusername)
+	}
+
+	return nil
+}
+
+// principalRealm returns the realm of the provided Kerberos username (ie.
+// login@REALM) or an empty string if there is none.
+func principalRealm(krbusername string) string {
+	i := strings.LastIndex(krbusername, "@")
+	if i < 0 {
+		return ""
+	}
+	return krbusername[i+1:]
+}
@@ -0,0 +1,137 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cea-hpc/gssapi/spnego"
+)
+
+var defaultKeytabCheckInterval = 30 * time.Second
+
+// Old server credentials are released after this delay so that requests
+// using them can complete.
+const credentialReleaseDelay = time.Minute
+
+// keytabState identifies the content of a keytab file.
+type keytabState struct {
+	inode   uint64
+	size    int64
+	modTime time.Time
+}
+
+func getKeytabState(keytab string) (keytabState, error) {
+	fi, err := os.Stat(keytab)
+	if err != nil {
+		return keytabState{}, err
+	}
+
+	state := keytabState{size: fi.Size(), modTime: fi.ModTime()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		state.inode = st.Ino
+	}
+	return state, nil
+}
+
+// credentialsHolder holds the current server credentials. They can be
+// replaced atomically while requests are served.
+type credentialsHolder struct {
+	current   atomic.Value // *serverCredentials
+	mu        sync.Mutex   // serializes reloads
+	server    spnego.KerberizedServer
+	keytab    string
+	services  []servicePrincipal
+	acceptAny bool
+}
+
+// get returns the current server credentials.
+func (h *credentialsHolder) get() *serverCredentials {
+	return h.current.Load().(*serverCredentials)
+}
+
+// keytabs returns the keytab files used by the current credentials.
+func (h *credentialsHolder) keytabs() []string {
+	keytabs := []string{}
+	seen := make(map[string]bool)
+	for _, c := range h.get().all {
+		if !seen[c.keytab] {
+			seen[c.keytab] = true
+			keytabs = append(keytabs, c.keytab)
+		}
+	}
+	return keytabs
+}
+
+// reload acquires new server credentials and replaces the current ones. On
+// failure the current credentials are kept.
+func (h *credentialsHolder) reload(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	log.Printf("INFO: re-acquiring server credentials: %s", reason)
+
+	creds, err := acquireServerCredentials(h.server, h.keytab, h.services, h.acceptAny)
+	if err != nil {
+		log.Printf("ERROR: re-acquiring server credentials: %v: keeping current credentials", err)
+		return
+	}
+
+	old := h.get()
+	h.current.Store(creds)
+	time.AfterFunc(credentialReleaseDelay, old.release)
+
+	log.Printf("INFO: server credentials replaced")
+}
+
+// watch re-acquires the server credentials when a keytab file changes (checked
+// every interval) or when a signal is received on the provided channel.
+func (h *credentialsHolder) watch(interval time.Duration, reload <-chan os.Signal) {
+	states := make(map[string]keytabState)
+	for _, keytab := range h.keytabs() {
+		state, err := getKeytabState(keytab)
+		if err != nil {
+			log.Printf("ERROR: cannot watch keytab: %v", err)
+		}
+		states[keytab] = state
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case sig := <-reload:
+			h.reload("received " + sig.String())
+		case <-ticker.C:
+			changed := ""
+			for keytab, state := range states {
+				newState, err := getKeytabState(keytab)
+				if err != nil {
+					// The keytab may be being replaced.
+					log.Printf("ERROR: cannot check keytab: %v", err)
+					continue
+				}
+				if newState != state {
+					states[keytab] = newState
+					changed = keytab
+				}
+			}
+			if changed != "" {
+				h.reload("keytab " + changed + " changed")
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Access modes of routes.
+const (
+	routeReadOnly   = "ro"          // files can only be read
+	routeReadWrite  = "rw"          // files can be created, modified and removed
+	routeNoDelete   = "no-delete"   // files can be created and modified but not removed
+	routeAppendOnly = "append-only" // files can only be created
+)
+
+// routeConfig defines the file-system path a route gives access to and how.
+// In configuration files it is either a path or a mapping.
+type routeConfig struct {
+	Path           string   // exported path
+	Mode           string   // access mode (default: ro)
+	Include        []string // glob patterns of the only files served
+	Exclude        []string // glob patterns of hidden entries
+	DefaultExclude *bool    `yaml:"default_exclude"` // hide the secrets of the user (default: true)
+}
+
+// UnmarshalYAML accepts a path or a mapping.
+func (r *routeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&r.Path); err == nil {
+		return nil
+	}
+	type plain routeConfig
+	return unmarshal((*plain)(r))
+}
+
+// arg returns the argument of the user file server for the route, with the
+// already expanded exported path: pattern?options:path.
+func (r *routeConfig) arg(pattern, exportedPath string) string {
+	options := url.Values{}
+	if r.Mode != "" && r.Mode != routeReadOnly {
+		options.Set("mode", r.Mode)
+	}
+	for _, pattern := range r.Include {
+		options.Add("include", pattern)
+	}
+	for _, pattern := range r.Exclude {
+		options.Add("exclude", pattern)
+	}
+	if r.DefaultExclude != nil && !*r.DefaultExclude {
+		options.Set("default_exclude", "false")
+	}
+	if len(options) != 0 {
+		pattern += "?" + options.Encode()
+	}
+	return pattern + ":" + exportedPath
+}
+
+type routesMap map[string]routeConfig
+
+// check returns an error if a route is invalid.
+func (m routesMap) check() error {
+	for pattern, r := range m {
+		if strings.ContainsAny(pattern, "?:") {
+			return fmt.Errorf("invalid character in route %s", pattern)
+		}
+		switch r.Mode {
+		case "", routeReadOnly, routeReadWrite, routeNoDelete, routeAppendOnly:
+		default:
+			return fmt.Errorf("invalid mode of route %s: %s", pattern, r.Mode)
+		}
+		for _, glob := range append(r.Include, r.Exclude...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("invalid pattern of route %s: %s", pattern, glob)
+			}
+		}
+	}
+	return nil
+}
+
+// routeSet is a set of web routes only given to users matching its groups and
+// realms.
+type routeSet struct {
+	Groups    []string  // group name patterns (only one '*' wildcard allowed)
+	Realms    []string  // Kerberos realms
+	Exclusive bool      // routes replace the global ones instead of extending them
+	Routes    routesMap // web routing definition
+}
+
+// Patterns only available in route sets.
+const (
+	groupPattern      = "{{GROUP}}"
+	groupMatchPattern = "{{GROUP_MATCH}}"
+	realmPattern      = "{{REALM}}"
+)
+
+// check returns an error if the route set is invalid.
+func (s *routeSet) check() error {
+	if len(s.Routes) == 0 {
+		return fmt.Errorf("route set without routes")
+	}
+	if err := s.Routes.check(); err != nil {
+		return err
+	}
+
+	for _, pattern := range s.Groups {
+		if strings.Count(pattern, "*") > 1 {
+			return fmt.Errorf("group pattern %s has more than one wildcard", pattern)
+		}
+	}
+
+	if len(s.Groups) == 0 {
+		for pattern, r := range s.Routes {
+			if strings.Contains(pattern+r.Path, groupPattern) ||
+				strings.Contains(pattern+r.Path, groupMatchPattern) {
+				return fmt.Errorf("route %s uses a group pattern without groups defined", pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+// usesGroups returns true if the route set depends on user groups.
+func (s *routeSet) usesGroups() bool {
+	return len(s.Groups) != 0
+}
+
+// matchGroup returns true if the group matches the pattern and the part of
+// the group name matched by the wildcard (or the whole name if there is no
+// wildcard). The wildcard must match at least one character.
+func matchGroup(pattern, group string) (string, bool) {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return group, pattern == group
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(group) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(group, prefix) || !strings.HasSuffix(group, suffix) {
+		return "", false
+	}
+
+	return group[len(prefix) : len(group)-len(suffix)], true
+}
+
+// expand adds to routes the routes of the set for the provided realm and
+// group (which may be empty).
+func (s *routeSet) expand(routes routesMap, realm, group, match string) {
+	replacer := strings.NewReplacer(groupPattern, group, groupMatchPattern, match, realmPattern, realm)
+	for pattern, r := range s.Routes {
+		r.Path = replacer.Replace(r.Path)
+		routes[replacer.Replace(pattern)] = r
+	}
+}
+
+// resolveRoutes returns the routes of a user in the provided realm and member
+// of the provided groups. Routes of matching sets are added to the global
+// routes, except if one of them is exclusive: only routes of matching
+// exclusive sets are then used.
+func resolveRoutes(global routesMap, sets []routeSet, realm string, groups []string) routesMap {
+	inclusive := routesMap{}
+	exclusive := routesMap{}
+	hasExclusive := false
+
+	for i := range sets {
+		set := &sets[i]
+		if len(set.Realms) != 0 && !contains(set.Realms, realm) {
+			continue
+		}
+
+		routes := inclusive
+		if set.Exclusive {
+			routes = exclusive
+		}
+
+		if !set.usesGroups() {
+			set.expand(routes, realm, "", "")
+			hasExclusive = hasExclusive || set.Exclusive
+			continue
+		}
+
+		for _, group := range groups {
+			for _, pattern := range set.Groups {
+				if match, ok := matchGroup(pattern, group); ok {
+					set.expand(routes, realm, group, match)
+					hasExclusive = hasExclusive || set.Exclusive
+					break
+				}
+			}
+		}
+	}
+
+	if hasExclusive {
+		return exclusive
+	}
+
+	routes := routesMap{}
+	for pattern, r := range global {
+		routes[pattern] = r
+	}
+	for pattern, r := range inclusive {
+		routes[pattern] = r
+	}
+
+	return routes
+}
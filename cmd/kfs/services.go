@@ -0,0 +1,177 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cea-hpc/gssapi"
+	"github.com/cea-hpc/gssapi/spnego"
+)
+
+// servicePrincipal defines a Kerberos service principal the server answers
+// as.
+type servicePrincipal struct {
+	Name   string   // principal name (e.g. HTTP/kfs.example.com)
+	Keytab string   // keytab of the principal (default: keytab)
+	Hosts  []string // host names selecting the principal (default: host of the principal)
+}
+
+// principalHost returns the host part of a service principal name (ie.
+// service/host@REALM) or an empty string if there is none.
+func principalHost(name string) string {
+	fields := strings.SplitN(name, "/", 2)
+	if len(fields) != 2 {
+		return ""
+	}
+	return strings.SplitN(fields[1], "@", 2)[0]
+}
+
+// initServicePrincipals sets default values of the service principals and
+// checks them.
+func initServicePrincipals(services []servicePrincipal, keytab string) error {
+	hosts := make(map[string]bool)
+	for i := range services {
+		s := &services[i]
+		if s.Name == "" {
+			return fmt.Errorf("service principal %d has no name", i+1)
+		}
+		if s.Keytab == "" {
+			s.Keytab = keytab
+		}
+		if len(s.Hosts) == 0 {
+			if host := principalHost(s.Name); host != "" {
+				s.Hosts = []string{host}
+			}
+		}
+		for _, host := range s.Hosts {
+			host = strings.ToLower(host)
+			if hosts[host] {
+				return fmt.Errorf("host %s is selecting several service principals", host)
+			}
+			hosts[host] = true
+		}
+	}
+	return nil
+}
+
+// serverCredential is an acquired server credential.
+type serverCredential struct {
+	principal string         // principal name (empty: any principal of the keytab)
+	keytab    string         // keytab the credential was acquired from
+	cred      *gssapi.CredId // credential (nil: GSS_C_NO_CREDENTIAL)
+	acquired  time.Time      // acquisition time
+}
+
+// String returns a description of the credential for logs.
+func (c *serverCredential) String() string {
+	principal := c.principal
+	if principal == "" {
+		principal = "any principal"
+	}
+	return fmt.Sprintf("%s from %s", principal, c.keytab)
+}
+
+// serverCredentials records the acquired server credentials.
+type serverCredentials struct {
+	all    []*serverCredential          // credentials, the first one is the default
+	byHost map[string]*serverCredential // credentials selected by host name
+}
+
+// acquireCredential acquires the credential of a principal (or any principal if
+// it is empty) from a keytab.
+func acquireCredential(server spnego.KerberizedServer, principal, keytab, defaultKeytab string) (*serverCredential, error) {
+	c := &serverCredential{principal: principal, keytab: keytab}
+
+	var err error
+	switch {
+	case keytab != defaultKeytab:
+		c.cred, err = AcquireCredFrom(server.Lib, principal, keytab)
+	case principal != "":
+		c.cred, err = server.AcquireCred(principal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("acquiring credential for %s: %v", c, err)
+	}
+
+	c.acquired = time.Now()
+	log.Printf("INFO: acquired credential for %s", c)
+
+	return c, nil
+}
+
+// acquireServerCredentials acquires the credentials of all service principals
+// or, if acceptAny is true, a credential accepting any principal of the
+// keytab.
+func acquireServerCredentials(server spnego.KerberizedServer, keytab string, services []servicePrincipal, acceptAny bool) (*serverCredentials, error) {
+	creds := &serverCredentials{byHost: make(map[string]*serverCredential)}
+
+	if acceptAny {
+		c, err := acquireCredential(server, "", keytab, keytab)
+		if err != nil {
+			return nil, err
+		}
+		creds.all = append(creds.all, c)
+		return creds, nil
+	}
+
+	if len(services) == 0 {
+		return nil, errors.New("no service principal defined")
+	}
+
+	for _, s := range services {
+		c, err := acquireCredential(server, s.Name, s.Keytab, keytab)
+		if err != nil {
+			creds.release()
+			return nil, err
+		}
+		creds.all = append(creds.all, c)
+		for _, host := range s.Hosts {
+			creds.byHost[strings.ToLower(host)] = c
+		}
+	}
+
+	return creds, nil
+}
+
+// release releases all credentials.
+func (s *serverCredentials) release() {
+	for _, c := range s.all {
+		c.cred.Release()
+	}
+}
+
+// requestHost returns the host name requested by the client: the TLS server
+// name or else the Host header.
+func requestHost(r *http.Request) string {
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		return strings.ToLower(r.TLS.ServerName)
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+// forRequest returns the credential to use for the request.
+func (s *serverCredentials) forRequest(r *http.Request) *serverCredential {
+	if c, ok := s.byHost[requestHost(r)]; ok {
+		return c
+	}
+	return s.all[0]
+}
@@ -0,0 +1,324 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var defaultStateDir = "/var/lib/kfs"
+
+// Delay given to orphaned user file servers to stop before being killed.
+const orphanStopDelay = 5 * time.Second
+
+// errStateLocked is returned when the state directory is used by another kfs
+// process.
+var errStateLocked = errors.New("state directory is locked by a running kfs server")
+
+// userState records the credential caches and the user file server process
+// created for a user, so that they can be cleaned up if kfs stops abruptly.
+type userState struct {
+	User     string   `json:"user"`
+	UID      string   `json:"uid"`
+	Ccaches  []string `json:"ccaches,omitempty"`
+	PID      int      `json:"pid,omitempty"`
+	PIDStart uint64   `json:"pid_start,omitempty"` // process start time (clock ticks after boot)
+}
+
+// stateDir is the directory where user states are recorded, one JSON file per
+// user. It is locked while in use.
+type stateDir struct {
+	dir  string
+	lock *os.File
+	mu   sync.Mutex
+}
+
+// openStateDir creates if needed and locks the state directory. It returns
+// errStateLocked if it is already locked.
+func openStateDir(dir string) (*stateDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errStateLocked
+		}
+		return nil, err
+	}
+
+	return &stateDir{dir: dir, lock: lock}, nil
+}
+
+// Close unlocks the state directory.
+func (s *stateDir) Close() error {
+	return s.lock.Close()
+}
+
+func (s *stateDir) path(username string) string {
+	return filepath.Join(s.dir, username+".json")
+}
+
+// read returns the recorded state of the user (empty if there is none).
+func (s *stateDir) read(username string) (*userState, error) {
+	st := &userState{}
+	data, err := ioutil.ReadFile(s.path(username))
+	switch {
+	case os.IsNotExist(err):
+		return st, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.path(username), err)
+	}
+	return st, nil
+}
+
+// write records atomically the state of the user. The file is removed if
+// there is nothing to record.
+func (s *stateDir) write(username string, st *userState) error {
+	if len(st.Ccaches) == 0 && st.PID == 0 {
+		if err := os.Remove(s.path(username)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(username) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(username))
+}
+
+// update modifies the recorded state of the user. Errors are logged: they
+// must not prevent users from working.
+func (s *stateDir) update(userInfo *user.User, f func(st *userState)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.read(userInfo.Username)
+	if err == nil {
+		st.User = userInfo.Username
+		st.UID = userInfo.Uid
+		f(st)
+		err = s.write(userInfo.Username, st)
+	}
+	if err != nil {
+		log.Printf("[%s] ERROR: recording state: %v", userInfo.Username, err)
+	}
+}
+
+// addCcache records a credential cache of the user.
+func (s *stateDir) addCcache(userInfo *user.User, krb5ccname string) {
+	s.update(userInfo, func(st *userState) {
+		st.Ccaches = append(st.Ccaches, krb5ccname)
+	})
+}
+
+// removeCcache forgets a credential cache of the user.
+func (s *stateDir) removeCcache(userInfo *user.User, krb5ccname string) {
+	s.update(userInfo, func(st *userState) {
+		ccaches := st.Ccaches[:0]
+		for _, c := range st.Ccaches {
+			if c != krb5ccname {
+				ccaches = append(ccaches, c)
+			}
+		}
+		st.Ccaches = ccaches
+	})
+}
+
+// setProcess records the user file server process of the user.
+func (s *stateDir) setProcess(userInfo *user.User, pid int) {
+	start, err := processStart(pid)
+	if err != nil {
+		log.Printf("[%s] ERROR: recording process %d: %v", userInfo.Username, pid, err)
+		return
+	}
+	s.update(userInfo, func(st *userState) {
+		st.PID = pid
+		st.PIDStart = start
+	})
+}
+
+// clearProcess forgets the user file server process of the user.
+func (s *stateDir) clearProcess(userInfo *user.User, pid int) {
+	s.update(userInfo, func(st *userState) {
+		if st.PID == pid {
+			st.PID = 0
+			st.PIDStart = 0
+		}
+	})
+}
+
+// processStart returns the start time of the process in clock ticks after
+// boot, which identifies it with its PID.
+func processStart(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces and parentheses: fields are
+	// counted after the last parenthesis, starting with the state (3rd
+	// field). The start time is the 22nd field.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// stopOrphan stops the process if it is still the recorded one and belongs to
+// the user.
+func stopOrphan(st *userState) error {
+	start, err := processStart(st.PID)
+	if err != nil || start != st.PIDStart {
+		// The process has already exited.
+		return nil
+	}
+	fi, err := os.Stat(fmt.Sprintf("/proc/%d", st.PID))
+	if err != nil {
+		return nil
+	}
+	if sys, ok := fi.Sys().(*syscall.Stat_t); !ok || strconv.FormatUint(uint64(sys.Uid), 10) != st.UID {
+		return fmt.Errorf("process %d is not owned by %s", st.PID, st.User)
+	}
+
+	log.Printf("[%s] INFO: stopping orphaned user file server (PID %d)", st.User, st.PID)
+	if err := syscall.Kill(st.PID, syscall.SIGTERM); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(orphanStopDelay); time.Now().Before(deadline); {
+		if start, err := processStart(st.PID); err != nil || start != st.PIDStart {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("[%s] INFO: killing orphaned user file server (PID %d)", st.User, st.PID)
+	return syscall.Kill(st.PID, syscall.SIGKILL)
+}
+
+// cleanup stops the user file servers and removes the credential caches
+// recorded in the state directory, which were left by a previous kfs run. It
+// returns the number of errors, which are logged. States with errors are kept
+// for a later cleanup.
+func (s *stateDir) cleanup(ccache *ccacheConfig) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		log.Printf("ERROR: listing state directory: %v", err)
+		return 1
+	}
+
+	nerrors := 0
+	for _, file := range files {
+		username := strings.TrimSuffix(filepath.Base(file), ".json")
+		st, err := s.read(username)
+		if err != nil {
+			log.Printf("ERROR: reading state: %v", err)
+			nerrors++
+			continue
+		}
+
+		if st.PID != 0 {
+			if err := stopOrphan(st); err != nil {
+				log.Printf("[%s] ERROR: stopping orphaned user file server: %v", username, err)
+				nerrors++
+				continue
+			}
+			st.PID = 0
+			st.PIDStart = 0
+		}
+
+		userInfo, err := user.LookupId(st.UID)
+		if err != nil {
+			log.Printf("[%s] ERROR: looking up user: %v", username, err)
+			nerrors++
+			continue
+		}
+		var left []string
+		for _, krb5ccname := range st.Ccaches {
+			log.Printf("[%s] INFO: removing orphaned credential cache %s", username, krb5ccname)
+			if err := ccache.remove(userInfo, krb5ccname); err != nil && !os.IsNotExist(err) {
+				log.Printf("[%s] ERROR: removing credential cache: %v", username, err)
+				nerrors++
+				left = append(left, krb5ccname)
+			}
+		}
+		st.Ccaches = left
+
+		if err := s.write(username, st); err != nil {
+			log.Printf("[%s] ERROR: recording state: %v", username, err)
+			nerrors++
+		}
+	}
+	return nerrors
+}
+
+// cleanupCommand runs the cleanup of the state directory on demand: kfs
+// cleanup /path/to/config. It returns the exit code.
+func cleanupCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: kfs cleanup /path/to/config")
+		return 2
+	}
+
+	cfg, err := loadConfig(args[0])
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return 1
+	}
+
+	s, err := openStateDir(cfg.StateDir)
+	if err != nil {
+		log.Printf("ERROR: opening state directory: %v", err)
+		return 1
+	}
+	defer s.Close()
+
+	if n := s.cleanup(&cfg.Ccache); n > 0 {
+		log.Printf("ERROR: cleanup finished with %d errors", n)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,326 @@
+// Copyright 2018-2023 CEA/DAM/DIF
+//  Contributor: Arnaud Guignard <arnaud.guignard@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL path of the token endpoint. It is handled by kfs and never proxied to
+// user file servers.
+const tokensPath = "/.kfs/tokens"
+
+var defaultTokenMaxLifetime = 24 * time.Hour
+
+// Token scopes.
+const (
+	tokenScopeRead  = "read"
+	tokenScopeWrite = "write"
+)
+
+// tokenConfig defines personal API tokens.
+type tokenConfig struct {
+	Enabled     bool          // enable the token endpoint
+	MaxLifetime time.Duration `yaml:"max_lifetime"` // maximum lifetime of a token
+}
+
+// init sets default values and checks the configuration.
+func (c *tokenConfig) init() error {
+	if c.MaxLifetime == 0 {
+		c.MaxLifetime = defaultTokenMaxLifetime
+	}
+	if c.MaxLifetime < 0 {
+		return errors.New("maximum lifetime of tokens cannot be a negative number")
+	}
+	return nil
+}
+
+// apiToken is a personal API token. It is bound to the session of the user
+// file server which was running when it was minted: it becomes invalid when
+// the server stops.
+type apiToken struct {
+	ID          string          `json:"id"`
+	Routes      []string        `json:"routes"`
+	Scope       string          `json:"scope"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+	krbusername string          // owner of the token
+	hash        [32]byte        // SHA-256 of the token secret
+	fs          *UserFileServer // user file server of the owner
+	session     uint64          // session of the user file server
+}
+
+// valid returns true if the token is usable.
+func (t *apiToken) valid(now time.Time) bool {
+	alive, session, _ := t.fs.running()
+	return now.Before(t.Expires) && alive && session == t.session
+}
+
+// allows returns true if the token gives access to the request.
+func (t *apiToken) allows(r *http.Request) bool {
+	if t.Scope != tokenScopeWrite {
+		switch {
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions, r.Method == "PROPFIND":
+		// Archives of selected files are downloaded with a POST request.
+		// The body is not read here: it is proxied.
+		case r.Method == http.MethodPost && r.URL.Query().Get("op") == "archive":
+		default:
+			return false
+		}
+	}
+
+	if len(t.Routes) == 0 {
+		return true
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	for _, route := range t.Routes {
+		if route == "/" || urlPath == route || strings.HasPrefix(urlPath, route+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenStore records the API tokens of all users.
+type tokenStore struct {
+	sync.Mutex
+	cfg    *tokenConfig
+	tokens map[string]*apiToken
+}
+
+func newTokenStore(cfg *tokenConfig) *tokenStore {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &tokenStore{
+		cfg:    cfg,
+		tokens: make(map[string]*apiToken),
+	}
+}
+
+// purge removes invalid tokens. It must be called with the lock held.
+func (s *tokenStore) purge(now time.Time) {
+	for id, t := range s.tokens {
+		if !t.valid(now) {
+			delete(s.tokens, id)
+		}
+	}
+}
+
+// mint creates a new token for the user file server. It returns the token and
+// its secret value to be given to the user.
+func (s *tokenStore) mint(krbusername string, fs *UserFileServer, routes []string, scope string, lifetime time.Duration) (*apiToken, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	_, session, eol := fs.running()
+	now := time.Now()
+	if lifetime <= 0 || lifetime > s.cfg.MaxLifetime {
+		lifetime = s.cfg.MaxLifetime
+	}
+	expires := now.Add(lifetime)
+	if eol.Before(expires) {
+		expires = eol
+	}
+
+	t := &apiToken{
+		ID:          hex.EncodeToString(id),
+		Routes:      routes,
+		Scope:       scope,
+		Created:     now,
+		Expires:     expires,
+		krbusername: krbusername,
+		hash:        sha256.Sum256(secret),
+		fs:          fs,
+		session:     session,
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.purge(now)
+	s.tokens[t.ID] = t
+
+	return t, fmt.Sprintf("kfs_%s.%s", t.ID, base64.RawURLEncoding.EncodeToString(secret)), nil
+}
+
+// lookup returns the valid token matching the provided value.
+func (s *tokenStore) lookup(value string) (*apiToken, error) {
+	fields := strings.SplitN(strings.TrimPrefix(value, "kfs_"), ".", 2)
+	if len(fields) != 2 {
+		return nil, errors.New("malformed token")
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.tokens[fields[0]]
+	if !ok {
+		return nil, errors.New("unknown token")
+	}
+
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(hash[:], t.hash[:]) != 1 {
+		return nil, errors.New("invalid token secret")
+	}
+
+	if !t.valid(time.Now()) {
+		delete(s.tokens, t.ID)
+		return nil, errors.New("expired token")
+	}
+
+	return t, nil
+}
+
+// list returns the valid tokens of the user sorted by creation time.
+func (s *tokenStore) list(krbusername string) []*apiToken {
+	s.Lock()
+	defer s.Unlock()
+
+	s.purge(time.Now())
+	tokens := []*apiToken{}
+	for _, t := range s.tokens {
+		if t.krbusername == krbusername {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+
+	return tokens
+}
+
+// revoke removes a token of the user. It returns false if there is no such
+// token.
+func (s *tokenStore) revoke(krbusername, id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || t.krbusername != krbusername {
+		return false
+	}
+	delete(s.tokens, id)
+
+	return true
+}
+
+// isTokensPath returns true if the URL path is handled by the token endpoint.
+func isTokensPath(urlPath string) bool {
+	return urlPath == tokensPath || strings.HasPrefix(urlPath, tokensPath+"/")
+}
+
+// bearerToken returns the bearer token of the request if any.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("ERROR: encoding JSON response: %v", err)
+	}
+}
+
+// tokensHandler handles the token endpoint for an authenticated user:
+//
+//	GET /.kfs/tokens lists the tokens of the user,
+//	POST /.kfs/tokens mints a token with the optional form parameters routes
+//	(comma separated URL paths), scope (read or write) and lifetime,
+//	DELETE /.kfs/tokens/<id> revokes a token.
+func tokensHandler(w http.ResponseWriter, r *http.Request, s *tokenStore, krbusername string, fs *UserFileServer) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, tokensPath), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, s.list(krbusername))
+
+	case r.Method == http.MethodPost && id == "":
+		scope := r.FormValue("scope")
+		if scope == "" {
+			scope = tokenScopeRead
+		}
+		if scope != tokenScopeRead && scope != tokenScopeWrite {
+			http.Error(w, "Invalid scope.", http.StatusBadRequest)
+			return
+		}
+
+		var lifetime time.Duration
+		if v := r.FormValue("lifetime"); v != "" {
+			var err error
+			if lifetime, err = time.ParseDuration(v); err != nil || lifetime <= 0 {
+				http.Error(w, "Invalid lifetime.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		routes := []string{}
+		for _, route := range strings.Split(r.FormValue("routes"), ",") {
+			if route = strings.TrimSpace(route); route != "" {
+				routes = append(routes, path.Clean("/"+route))
+			}
+		}
+
+		t, value, err := s.mint(krbusername, fs, routes, scope, lifetime)
+		if err != nil {
+			log.Printf("[%s] ERROR: minting token: %v", krbusername, err)
+			internalServerError(w)
+			return
+		}
+		log.Printf("[%s] INFO: minted token %s scope=%s routes=%v expires=%s", krbusername,
+			t.ID, t.Scope, t.Routes, t.Expires.Format(time.RFC3339))
+
+		writeJSON(w, http.StatusCreated, struct {
+			*apiToken
+			Token string `json:"token"`
+		}{t, value})
+
+	case r.Method == http.MethodDelete && id != "":
+		if !s.revoke(krbusername, id) {
+			http.Error(w, "Not found.", http.StatusNotFound)
+			return
+		}
+		log.Printf("[%s] INFO: revoked token %s", krbusername, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
@@ -18,8 +18,11 @@ import (
 	"os/user"
 	"regexp"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/cea-hpc/kfs"
 )
 
 // Regexps used.
@@ -32,7 +35,7 @@ var (
 // the user.
 type UserFileServer struct {
 	Listen      string        // listening address
-	Alive       bool          // is the server alive?
+	Alive       bool          // is the server alive? (protected by mu)
 	credentials string        // credentials
 	eol         time.Time     // end of life
 	user        *user.User    // owner of process
@@ -41,11 +44,57 @@ type UserFileServer struct {
 	cmdPath     string        // path to user file server binary
 	maxLifetime time.Duration // max lifetime of server
 	routes      routesMap     // web routes
+	routeSets   []routeSet    // group and realm conditional web routes
+	realm       string        // Kerberos realm of the user who started the server
+	session     uint64        // number of starts of the server
+	secret      string        // authenticates requests to the server (see kfs.SecretHeader)
+	renewMargin time.Duration // renew credentials this long before expiry (0: no renewal)
+	deadline    time.Time     // end of life cannot be extended past this time by renewals
+	renewTimer  *time.Timer   // timer used for renewing credentials
+	impersonate bool          // credentials come from constrained delegation: they hold no TGT
+	mu          sync.Mutex    // protects state, session, realm, credentials, secret, end of life and timers
+	ccache      *ccacheConfig // credential caches configuration
+	state       *stateDir     // records credential caches and process
+	archive     *archiveConfig
+}
+
+// Default limits of archives.
+const (
+	defaultArchiveMaxSize  = 10 << 30 // 10 GiB
+	defaultArchiveMaxFiles = 100000
+)
+
+// archiveConfig limits the archives of directories built by user file servers.
+type archiveConfig struct {
+	MaxSize  int64 `yaml:"max_size"`  // maximum total size of archived files in bytes
+	MaxFiles int   `yaml:"max_files"` // maximum number of archived files
+}
+
+// init sets default values and checks the limits.
+func (c *archiveConfig) init() error {
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("archive limits cannot be negative numbers")
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultArchiveMaxSize
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = defaultArchiveMaxFiles
+	}
+	return nil
+}
+
+// args returns the options of the user file server.
+func (c *archiveConfig) args() []string {
+	return []string{
+		fmt.Sprintf("-archive-max-size=%d", c.MaxSize),
+		fmt.Sprintf("-archive-max-files=%d", c.MaxFiles),
+	}
 }
 
 // NewUserFileServer returns a new UserFileServer instance initialized with
 // user infos, path to the use file server binary and web routes.
-func NewUserFileServer(userInfo *user.User, userFileServerPath string, lifetime time.Duration, routes routesMap) *UserFileServer {
+func NewUserFileServer(userInfo *user.User, userFileServerPath string, lifetime time.Duration, routes routesMap, routeSets []routeSet, renewMargin time.Duration, ccache *ccacheConfig, state *stateDir, archive *archiveConfig) *UserFileServer {
 	return &UserFileServer{
 		Listen:      "",
 		Alive:       false,
@@ -56,6 +105,40 @@ func NewUserFileServer(userInfo *user.User, userFileServerPath string, lifetime
 		cmdPath:     userFileServerPath,
 		maxLifetime: lifetime,
 		routes:      routes,
+		routeSets:   routeSets,
+		renewMargin: renewMargin,
+		ccache:      ccache,
+		state:       state,
+		archive:     archive,
+	}
+}
+
+// resolveRoutes returns the web routes of the user in the realm.
+func (u *UserFileServer) resolveRoutes(realm string) (routesMap, error) {
+	var groups []string
+	for i := range u.routeSets {
+		if u.routeSets[i].usesGroups() {
+			var err error
+			if groups, err = userGroups(u.user); err != nil {
+				return nil, fmt.Errorf("getting user groups: %v", err)
+			}
+			break
+		}
+	}
+
+	return resolveRoutes(u.routes, u.routeSets, realm, groups), nil
+}
+
+// userSysProcAttr returns the attributes of a process run as the user.
+func userSysProcAttr(userInfo *user.User) *syscall.SysProcAttr {
+	uid, _ := strconv.ParseUint(userInfo.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(userInfo.Gid, 10, 32)
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:         uint32(uid),
+			Gid:         uint32(gid),
+			NoSetGroups: false,
+		},
 	}
 }
 
@@ -69,12 +152,32 @@ func replace(s string, u *user.User) string {
 	return s
 }
 
-// Start starts a new HTTP file server as the already defined user. The server
-// will listen on localhost on a kernel determined port. It will use the
-// provided Kerberos credentials and will live for the provided lifetime.
-func (u *UserFileServer) Start(credentials string, lifetime time.Duration) error {
+// Start starts a new HTTP file server as the already defined user, logged in
+// from a principal of the provided realm. The server will listen on localhost
+// on a kernel determined port. It will use the provided Kerberos credentials
+// (obtained with constrained delegation if impersonated is true) and will live
+// for the provided lifetime.
+func (u *UserFileServer) Start(realm, credentials string, lifetime time.Duration, impersonated bool) error {
+	routes, err := u.resolveRoutes(realm)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("no route defined for user")
+	}
+
+	secret, err := randomName("")
+	if err != nil {
+		return fmt.Errorf("generating secret: %v", err)
+	}
+	u.mu.Lock()
+	u.session++
+	u.realm = realm
+	u.secret = secret
+	u.mu.Unlock()
+
 	// Set credentials
-	u.NewCredentials(credentials, lifetime)
+	u.NewCredentials(credentials, lifetime, impersonated)
 
 	// Shutdown the client after lifetime.
 	go func() {
@@ -83,28 +186,22 @@ func (u *UserFileServer) Start(credentials string, lifetime time.Duration) error
 		u.Shutdown()
 	}()
 
-	args := make([]string, len(u.routes))
-	i := 0
-	for pattern, exportedPath := range u.routes {
-		args[i] = fmt.Sprintf("%s:%s", pattern,
-			specialPatternsRegexp.ReplaceAllStringFunc(exportedPath, func(src string) string {
+	args := u.archive.args()
+	for pattern, r := range routes {
+		args = append(args, r.arg(pattern,
+			specialPatternsRegexp.ReplaceAllStringFunc(r.Path, func(src string) string {
 				return replace(src, u.user)
-			}))
-		i++
+			})))
 	}
 
 	u.cmd = exec.Command(u.cmdPath, args...)
+	u.cmd.Env = append(os.Environ(), kfs.SecretEnv+"="+secret)
+	if krb5ccname := u.ccache.env(u.user); krb5ccname != "" {
+		u.cmd.Env = append(u.cmd.Env, "KRB5CCNAME="+krb5ccname)
+	}
 
 	// Set user credentials to process.
-	uid, _ := strconv.ParseUint(u.user.Uid, 10, 32)
-	gid, _ := strconv.ParseUint(u.user.Gid, 10, 32)
-	u.cmd.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid:         uint32(uid),
-			Gid:         uint32(gid),
-			NoSetGroups: false,
-		},
-	}
+	u.cmd.SysProcAttr = userSysProcAttr(u.user)
 
 	// Will use a pipe to read stdout.
 	stdout, err := u.cmd.StdoutPipe()
@@ -117,6 +214,7 @@ func (u *UserFileServer) Start(credentials string, lifetime time.Duration) error
 	if err := u.cmd.Start(); err != nil {
 		return fmt.Errorf("starting command: %v", err)
 	}
+	u.state.setProcess(u.user, u.cmd.Process.Pid)
 
 	// Use a channel to notify when the server is ready.
 	started := make(chan struct{})
@@ -135,7 +233,9 @@ func (u *UserFileServer) Start(credentials string, lifetime time.Duration) error
 			matches := listenAddressRegexp.FindStringSubmatch(line)
 			if matches != nil && matches[1] != "" {
 				u.Listen = matches[1]
+				u.mu.Lock()
 				u.Alive = true
+				u.mu.Unlock()
 				close(started)
 			}
 		}
@@ -147,8 +247,11 @@ func (u *UserFileServer) Start(credentials string, lifetime time.Duration) error
 		if err := cmd.Wait(); err != nil {
 			u.Log("ERROR: waiting for user process to complete: %v", err)
 		}
+		u.state.clearProcess(u.user, cmd.Process.Pid)
 
+		u.mu.Lock()
 		u.Alive = false
+		u.mu.Unlock()
 	}()
 
 	select {
@@ -160,19 +263,61 @@ func (u *UserFileServer) Start(credentials string, lifetime time.Duration) error
 	}
 }
 
+// Secret returns the secret authenticating requests to the running server.
+func (u *UserFileServer) Secret() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.secret
+}
+
+// running returns whether the server is alive, its session and its end of
+// life.
+func (u *UserFileServer) running() (bool, uint64, time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.Alive, u.session, u.eol
+}
+
+// Realm returns the realm of the principal who started the server: its routes
+// were resolved for this realm.
+func (u *UserFileServer) Realm() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.realm
+}
+
 // Shutdown stops the file server and removes the credentials.
 func (u *UserFileServer) Shutdown() {
+	u.mu.Lock()
 	u.Alive = false
+	u.mu.Unlock()
 	u.RemoveCredentials()
 	u.cmd.Process.Signal(os.Interrupt)
 }
 
 // NewCredentials removes the old credentials (if any), then stores the new
-// credentials in a file and increases the server lifetime.
-func (u *UserFileServer) NewCredentials(credentials string, credLifetime time.Duration) {
+// credentials in a file and increases the server lifetime. Credentials
+// obtained with constrained delegation (impersonated) are not renewed.
+func (u *UserFileServer) NewCredentials(credentials string, credLifetime time.Duration, impersonated bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.impersonate = impersonated
+
+	u.deadline = time.Time{}
+	if u.maxLifetime > 0 {
+		u.deadline = time.Now().Add(u.maxLifetime)
+	}
+	u.setCredentials(credentials, credLifetime)
+	u.scheduleRenewal()
+}
+
+// setCredentials replaces the credentials and sets the end of life of the
+// server. It must be called with the lock held.
+func (u *UserFileServer) setCredentials(credentials string, credLifetime time.Duration) {
 	lifetime := credLifetime
-	if u.maxLifetime > 0 && u.maxLifetime < credLifetime {
-		lifetime = u.maxLifetime
+	if !u.deadline.IsZero() && time.Until(u.deadline) < lifetime {
+		lifetime = time.Until(u.deadline)
 	}
 	u.eol = time.Now().Add(lifetime)
 	u.Log("set end of life of user file server to %s", u.eol.Format(time.RFC3339))
@@ -181,15 +326,89 @@ func (u *UserFileServer) NewCredentials(credentials string, credLifetime time.Du
 	} else {
 		u.timer = time.NewTimer(lifetime)
 	}
-	u.RemoveCredentials()
+	u.removeCredentials()
 	u.credentials = credentials
+	u.state.addCcache(u.user, credentials)
 }
 
-// RemoveCredentials removes the file where Kerberos credentials were stored.
+// scheduleRenewal schedules the renewal of the credentials if they contain a
+// renewable TGT. Impersonated credentials only hold service tickets. It must
+// be called with the lock held.
+func (u *UserFileServer) scheduleRenewal() {
+	if u.renewTimer != nil {
+		u.renewTimer.Stop()
+		u.renewTimer = nil
+	}
+
+	if u.renewMargin == 0 || u.credentials == "" || u.impersonate {
+		return
+	}
+
+	endtime, renewTill, err := u.ccache.times(u.user, u.credentials)
+	switch {
+	case err != nil:
+		u.Log("ERROR: cannot read TGT times: %v", err)
+		return
+	case !renewTill.After(endtime):
+		u.Log("INFO: credentials are not renewable")
+		return
+	case !u.deadline.IsZero() && !endtime.Before(u.deadline):
+		return
+	}
+
+	// Do not renew in a loop if the margin is greater than the ticket
+	// lifetime.
+	delay := time.Until(endtime.Add(-u.renewMargin))
+	if minDelay := time.Until(endtime) / 2; delay < minDelay {
+		delay = minDelay
+	}
+
+	u.Log("INFO: credentials will be renewed at %s (renewable until %s)",
+		time.Now().Add(delay).Format(time.RFC3339), renewTill.Format(time.RFC3339))
+	u.renewTimer = time.AfterFunc(delay, u.renew)
+}
+
+// renew renews the credentials and extends the server lifetime accordingly.
+func (u *UserFileServer) renew() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.Alive || u.credentials == "" {
+		return
+	}
+
+	credentials, endtime, err := u.ccache.renew(u.user, u.credentials)
+	if err != nil {
+		u.Log("ERROR: renewing credentials: %v", err)
+		return
+	}
+
+	u.Log("INFO: credentials renewed until %s", endtime.Format(time.RFC3339))
+	u.setCredentials(credentials, time.Until(endtime))
+	u.scheduleRenewal()
+}
+
+// RemoveCredentials removes the credential cache where Kerberos credentials
+// were stored.
 func (u *UserFileServer) RemoveCredentials() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.renewTimer != nil {
+		u.renewTimer.Stop()
+		u.renewTimer = nil
+	}
+	u.removeCredentials()
+}
+
+// removeCredentials removes the credential cache. It must be called with the
+// lock held.
+func (u *UserFileServer) removeCredentials() {
 	if u.credentials != "" {
-		if err := os.Remove(u.credentials); err != nil {
+		if err := u.ccache.remove(u.user, u.credentials); err != nil {
 			u.Log("ERROR: cannot remove %s: %v", u.credentials, err)
+		} else {
+			u.state.removeCcache(u.user, u.credentials)
 		}
 		u.credentials = ""
 	}
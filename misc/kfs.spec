@@ -48,6 +48,7 @@ install -d -m 0755 %{buildroot}%{_sysconfdir}/kfs
 install -p -m 0644 config/kfs.yaml %{buildroot}%{_sysconfdir}/kfs
 install -d -m 0755  %{buildroot}%{_unitdir}
 install -p -m 0644 misc/kfs.service %{buildroot}%{_unitdir}
+install -d -m 0700 %{buildroot}%{_sharedstatedir}/kfs
 
 %files
 %defattr(-,root,root,-)
@@ -56,6 +57,7 @@ install -p -m 0644 misc/kfs.service %{buildroot}%{_unitdir}
 %config(noreplace) %{_sysconfdir}/kfs/kfs.yaml
 %{_sbindir}/kfs
 %{_sbindir}/kfs-user
+%dir %{_sharedstatedir}/kfs
 
 %post
 %systemd_post %{name}.service
@@ -0,0 +1,14 @@
+package kfs
+
+// kfs authenticates to the user file servers with a random secret generated
+// for each start of a server: it is given in the environment of the server and
+// sent in a header of every proxied request.
+const (
+	SecretEnv    = "KFS_USER_SECRET"
+	SecretHeader = "Kfs-User-Secret"
+)
+
+// TokenRoutesHeader is the header of the requests proxied for a personal API
+// token limited to some routes: the comma separated list of the URL paths of
+// the routes.
+const TokenRoutesHeader = "Kfs-Token-Routes"